@@ -0,0 +1,297 @@
+package bow
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Count returns the amount of records in the bucket. Only keys are read,
+// which is much faster than iterating records.
+func (b *Bucket) Count() (int, error) {
+	return b.count(keyRange{})
+}
+
+// CountPrefix returns the amount of records whose key has the given prefix.
+func (b *Bucket) CountPrefix(prefix interface{}) (int, error) {
+	r, err := b.prefixRange(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return b.count(r)
+}
+
+// CountRange returns the amount of records whose key is greater than or
+// equal to start and less than end. Either may be nil for an open range.
+func (b *Bucket) CountRange(start, end interface{}) (int, error) {
+	r, err := b.rangeOf(start, end)
+	if err != nil {
+		return 0, err
+	}
+	return b.count(r)
+}
+
+func (b *Bucket) count(r keyRange) (int, error) {
+	n := 0
+	err := b.iterate(r, true, func(*Record) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// Stats summarizes the values of a numeric field.
+type Stats struct {
+	Count    int
+	Sum      float64
+	Min, Max float64
+}
+
+// Avg returns the average value, or 0 if there are no values.
+func (s Stats) Avg() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// accumulator accumulates the Stats of a field. Integers are summed as
+// int64 as well, so that sums above 2^53 aren't rounded at each addition,
+// unless the sum overflows.
+type accumulator struct {
+	Stats
+	ints     bool
+	intSum   int64
+	overflow bool
+}
+
+// add adds x, the value of an integer or a float field.
+func (a *accumulator) add(x reflect.Value) {
+	var f float64
+	switch x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := x.Int()
+		a.addInt(n)
+		f = float64(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := x.Uint()
+		if n > math.MaxInt64 {
+			a.overflow = true
+		} else {
+			a.addInt(int64(n))
+		}
+		f = float64(n)
+	default:
+		f = x.Float()
+	}
+	if a.Count == 0 || f < a.Min {
+		a.Min = f
+	}
+	if a.Count == 0 || f > a.Max {
+		a.Max = f
+	}
+	a.Count++
+	a.Sum += f
+}
+
+func (a *accumulator) addInt(n int64) {
+	a.ints = true
+	sum := a.intSum + n
+	if (n > 0 && sum < a.intSum) || (n < 0 && sum > a.intSum) {
+		a.overflow = true
+	}
+	a.intSum = sum
+}
+
+// stats returns the accumulated Stats.
+func (a *accumulator) stats() Stats {
+	s := a.Stats
+	if a.ints && !a.overflow {
+		s.Sum = float64(a.intSum)
+	}
+	return s
+}
+
+// Aggregation computes statistics of a numeric field of the records in a
+// bucket, in a single iteration.
+type Aggregation struct {
+	bucket  *Bucket
+	newType func() interface{}
+	field   string
+	r       keyRange
+	err     error
+}
+
+// Aggregate returns an Aggregation of the named field, which must be an
+// integer or a float. Records are decoded into the result of newType, which
+// must be a pointer to a struct.
+func (b *Bucket) Aggregate(newType func() interface{}, field string) *Aggregation {
+	return &Aggregation{bucket: b, newType: newType, field: field}
+}
+
+// Prefix limits the aggregation to records whose key has the given prefix.
+func (a *Aggregation) Prefix(prefix interface{}) *Aggregation {
+	if a.err == nil {
+		var r keyRange
+		r, a.err = a.bucket.prefixRange(prefix)
+		a.r.prefix = r.prefix
+	}
+	return a
+}
+
+// Range limits the aggregation to records whose key is greater than or equal
+// to start and less than end. Either may be nil for an open range.
+func (a *Aggregation) Range(start, end interface{}) *Aggregation {
+	if a.err == nil {
+		var r keyRange
+		r, a.err = a.bucket.rangeOf(start, end)
+		a.r.start, a.r.end = r.start, r.end
+	}
+	return a
+}
+
+// Stats returns the statistics of the field.
+func (a *Aggregation) Stats() (Stats, error) {
+	var acc accumulator
+	err := a.run("", func(group, x reflect.Value) {
+		acc.add(x)
+	})
+	return acc.stats(), err
+}
+
+// Sum returns the sum of the field.
+func (a *Aggregation) Sum() (float64, error) {
+	s, err := a.Stats()
+	return s.Sum, err
+}
+
+// Avg returns the average of the field, or 0 if there are no records.
+func (a *Aggregation) Avg() (float64, error) {
+	s, err := a.Stats()
+	return s.Avg(), err
+}
+
+// Min returns the minimum of the field, or 0 if there are no records.
+func (a *Aggregation) Min() (float64, error) {
+	s, err := a.Stats()
+	return s.Min, err
+}
+
+// Max returns the maximum of the field, or 0 if there are no records.
+func (a *Aggregation) Max() (float64, error) {
+	s, err := a.Stats()
+	return s.Max, err
+}
+
+// GroupBy returns the statistics of the field for each value of the named
+// field, which must be of a comparable type. If the field is an interface,
+// records holding values that aren't comparable in it, such as slices, fail
+// the aggregation.
+func (a *Aggregation) GroupBy(field string) (map[interface{}]Stats, error) {
+	accs := make(map[interface{}]*accumulator)
+	err := a.run(field, func(group, x reflect.Value) {
+		key := group.Interface()
+		acc, ok := accs[key]
+		if !ok {
+			acc = new(accumulator)
+			accs[key] = acc
+		}
+		acc.add(x)
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[interface{}]Stats, len(accs))
+	for key, acc := range accs {
+		groups[key] = acc.stats()
+	}
+	return groups, nil
+}
+
+// run decodes each record in range and calls fn with the value of the group
+// field, if given, and the value of the aggregated field.
+func (a *Aggregation) run(groupField string, fn func(group, x reflect.Value)) error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.newType == nil {
+		return fmt.Errorf("bow.Aggregate: newType is nil")
+	}
+	v := a.newType()
+	typ, err := newStructType(v, true)
+	if err != nil {
+		return err
+	}
+	sv := typ.value(v)
+	field, ok := typ.typ.FieldByName(a.field)
+	if !ok || !field.IsExported() || !isNumeric(field.Type.Kind()) {
+		return fmt.Errorf("bow.Aggregate: %s has no numeric field %s", typ.typ, a.field)
+	}
+	var group reflect.StructField
+	if groupField != "" {
+		group, ok = typ.typ.FieldByName(groupField)
+		if !ok || !group.IsExported() || !group.Type.Comparable() {
+			return fmt.Errorf("bow.Aggregate: %s has no comparable field %s",
+				typ.typ, groupField)
+		}
+	}
+	zero := reflect.Zero(typ.typ)
+	var decodeErr error
+	err = a.bucket.iterate(a.r, false, func(rec *Record) bool {
+		sv.value.Set(zero)
+		if decodeErr = rec.decode(typ, v); decodeErr != nil {
+			return false
+		}
+		x := sv.value.FieldByIndex(field.Index)
+		var g reflect.Value
+		if groupField != "" {
+			g = sv.value.FieldByIndex(group.Index)
+			// An interface may hold a value that isn't comparable.
+			if !g.Comparable() {
+				decodeErr = fmt.Errorf("bow.Aggregate: %s of key %q isn't comparable",
+					groupField, rec.Key())
+				return false
+			}
+		}
+		fn(g, x)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// rangeOf returns the keyRange of keys between start and end, either of which
+// may be nil, or a KeyError if either can't be encoded.
+func (b *Bucket) rangeOf(start, end interface{}) (keyRange, error) {
+	var r keyRange
+	var err error
+	if start != nil {
+		r.start, err = b.encodeKey("iterate", start)
+		if err != nil {
+			return r, err
+		}
+	}
+	if end != nil {
+		r.end, err = b.encodeKey("iterate", end)
+		if err != nil {
+			return r, err
+		}
+		if r.end == nil {
+			// An empty end is less than every key.
+			r.end = []byte{}
+		}
+	}
+	return r, nil
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
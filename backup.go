@@ -0,0 +1,396 @@
+package bow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// badgerBitDelete mirrors Badger's internal bit for deleted entries, which
+// it leaves in the meta of backed up entries.
+const badgerBitDelete byte = 1 << 0
+
+// backupSpaces are the spaces of bucketSpaces that backups include, so that
+// restored records are indexed. History isn't included, since Restore
+// doesn't preserve versions.
+var backupSpaces = [][]byte{textPrefix, geoPrefix, indexPrefix, refPrefix}
+
+// backupHeader precedes the Badger backup in the output of Backup.
+type backupHeader struct {
+	Version uint32
+	Buckets map[string]bucketMeta
+}
+
+// Backup writes the records of the given buckets, or of all buckets if
+// none are given, that changed at or after the given version, and returns
+// the latest version written. Pass 0 as since for a full backup, or one
+// more than the version returned by a previous call for an incremental
+// one. Buckets in namespaces aren't included, and neither is the history
+// of records.
+//
+// Restore the backup with Restore.
+func (db *DB) Backup(w io.Writer, since uint64, buckets ...string) (uint64, error) {
+	db.metaMu.RLock()
+	header := backupHeader{
+		Version: version,
+		Buckets: make(map[string]bucketMeta),
+	}
+	if len(buckets) == 0 {
+		for name, meta := range db.meta.Buckets {
+			header.Buckets[name] = meta
+		}
+	}
+	for _, name := range buckets {
+		meta, ok := db.meta.Buckets[name]
+		if !ok {
+			db.metaMu.RUnlock()
+			return 0, fmt.Errorf("bow.Backup: bucket %q doesn't exist", name)
+		}
+		header.Buckets[name] = meta
+	}
+	db.metaMu.RUnlock()
+
+	b, err := json.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(w, binary.LittleEndian, uint64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	stream := db.db.NewStream()
+	stream.LogPrefix = "bow.Backup"
+	stream.ChooseKey = func(item *badger.Item) bool {
+		id, ok := backupBucketId(item.Key())
+		if !ok {
+			return false
+		}
+		for _, meta := range header.Buckets {
+			if id == meta.Id {
+				return true
+			}
+		}
+		return false
+	}
+	latest, err := stream.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	if latest < since {
+		latest = since
+	}
+	return latest, nil
+}
+
+// Restore reads a backup written by Backup into the database. Buckets are
+// matched by name, so a bucket that already exists receives the records of
+// the bucket with the same name in the backup, and buckets that don't exist
+// are created. The indexes of the records are restored along with them, and
+// replace those of the records they overwrite.
+func (db *DB) Restore(r io.Reader) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	br := bufio.NewReaderSize(r, 16<<10)
+
+	b, err := readBackupChunk(br, nil)
+	if err != nil {
+		return err
+	}
+	var header backupHeader
+	err = json.Unmarshal(b, &header)
+	if err != nil {
+		return err
+	}
+	if header.Version != version {
+		return fmt.Errorf("bow.Restore: backup version %d isn't supported",
+			header.Version)
+	}
+
+	// Map bucket ids in the backup to buckets in this database.
+	buckets := make(map[bucketId]*Bucket, len(header.Buckets))
+	prefixes := make(map[bucketId][]byte, len(header.Buckets))
+	for name, meta := range header.Buckets {
+		bucket := db.Bucket(name)
+		if bucket.err != nil {
+			return bucket.err
+		}
+		buckets[meta.Id] = bucket
+		prefixes[meta.Id] = bucket.prefix
+	}
+
+	// The index entries of the records that the backup overwrites are read
+	// as of before the restore, since the backup's entries may precede their
+	// records, and are deleted once it's written unless it rewrote them.
+	snap := db.db.NewTransaction(false)
+	defer snap.Discard()
+	var stale [][]byte
+
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	var list pb.KVList
+	var lastKey []byte
+	for {
+		b, err = readBackupChunk(br, b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		list.Reset()
+		err = list.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			// Versions of a key are listed from newest to oldest, and only
+			// the newest matters.
+			if bytes.Equal(kv.Key, lastKey) {
+				continue
+			}
+			lastKey = kv.Key
+			key, ok := restoreKey(prefixes, kv.Key)
+			if !ok {
+				continue
+			}
+			if kv.Key[0] != reserved {
+				id, _ := backupBucketId(kv.Key)
+				bucket := buckets[id]
+				entries, err := bucket.indexEntries(snap, key[len(bucket.prefix):])
+				if err != nil {
+					return err
+				}
+				stale = append(stale, entries...)
+			}
+			deleted := len(kv.Meta) > 0 && kv.Meta[0]&badgerBitDelete != 0 ||
+				len(kv.UserMeta) > 0 && kv.UserMeta[0]&tombstone != 0
+			if deleted {
+				err = wb.Delete(key)
+			} else if bytes.HasPrefix(kv.Key, refPrefix) {
+				err = wb.Set(key, restoreRefValue(prefixes, kv.Key, kv.Value))
+			} else {
+				err = wb.Set(key, kv.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+	return db.deleteStale(stale, snap.ReadTs())
+}
+
+// indexEntries returns the keys of the entries of the record with the given
+// key in all the indexes within txn, including its docs.
+func (b *Bucket) indexEntries(txn *badger.Txn, key []byte) ([][]byte, error) {
+	entries, err := b.fieldEntries(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	text, err := b.textEntries(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	geo, err := b.geoEntries(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := b.refEntries(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, text...)
+	entries = append(entries, geo...)
+	return append(entries, refs...), nil
+}
+
+// deleteStale deletes the given keys, unless they were written after
+// version.
+func (db *DB) deleteStale(keys [][]byte, version uint64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	err := db.db.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if item.Version() > version {
+				continue
+			}
+			err = wb.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// backupBucketId returns the id of the top-level bucket that key belongs
+// to, either as a record or in one of backupSpaces.
+func backupBucketId(key []byte) (bucketId, bool) {
+	var id bucketId
+	if len(key) > 0 && key[0] == reserved {
+		space := backupSpace(key)
+		if space == nil {
+			return id, false
+		}
+		key = key[len(space):]
+	}
+	if len(key) < bucketIdSize || key[0] == namespaced {
+		return id, false
+	}
+	copy(id[:], key)
+	return id, true
+}
+
+// backupSpace returns the space of backupSpaces that key is in, or nil.
+func backupSpace(key []byte) []byte {
+	for _, space := range backupSpaces {
+		if bytes.HasPrefix(key, space) {
+			return space
+		}
+	}
+	return nil
+}
+
+// restorePrefix returns the prefix in this database of the bucket whose id
+// in the backup starts b, given the prefixes of the backed up buckets by
+// their ids.
+func restorePrefix(prefixes map[bucketId][]byte, b []byte) ([]byte, bool) {
+	if len(b) < bucketIdSize {
+		return nil, false
+	}
+	var id bucketId
+	copy(id[:], b)
+	prefix, ok := prefixes[id]
+	return prefix, ok
+}
+
+// restoreKey maps a key of a backup to this database, given the prefixes of
+// the backed up buckets by their ids. It returns false if the key belongs to
+// a bucket that isn't restored.
+func restoreKey(prefixes map[bucketId][]byte, key []byte) ([]byte, bool) {
+	id, ok := backupBucketId(key)
+	if !ok {
+		return nil, false
+	}
+	prefix, ok := prefixes[id]
+	if !ok {
+		return nil, false
+	}
+	space := backupSpace(key)
+	rest := key[len(space)+bucketIdSize:]
+	k := make([]byte, 0, len(space)+len(prefix)+len(rest))
+	k = append(k, space...)
+	k = append(k, prefix...)
+	k = append(k, rest...)
+	if !bytes.Equal(space, refPrefix) || len(rest) == 0 || rest[0] != 'r' {
+		return k, true
+	}
+
+	// A reference ends with the prefix of the referencing bucket, which is
+	// mapped as well, following the key of the referenced record and the
+	// field's name.
+	n, size := binary.Uvarint(rest[1:])
+	if size <= 0 || uint64(len(rest)-1-size) < n {
+		return nil, false
+	}
+	head := 1 + size + int(n)
+	end := bytes.IndexByte(rest[head:], 0)
+	if end < 0 {
+		return nil, false
+	}
+	head += end + 1
+	source := rest[head:]
+	sourcePrefix, ok := restorePrefix(prefixes, source)
+	if !ok {
+		return nil, false
+	}
+	k = k[:len(space)+len(prefix)+head]
+	k = append(k, sourcePrefix...)
+	return append(k, source[bucketIdSize:]...), true
+}
+
+// restoreRefValue maps the value of a key of a backup in refPrefix to this
+// database, like restoreKey maps the key.
+func restoreRefValue(prefixes map[bucketId][]byte, key, value []byte) []byte {
+	if len(key) <= len(refPrefix)+bucketIdSize {
+		return value
+	}
+	switch key[len(refPrefix)+bucketIdSize] {
+	case 'r':
+		var e refEntry
+		if e.unmarshal(value) != nil {
+			return value
+		}
+		if prefix, ok := restorePrefix(prefixes, e.prefix); ok {
+			e.prefix = prefix
+		}
+		return e.marshal()
+	case 'd':
+		// The keys of the record's references, of which only those that are
+		// restored are kept.
+		var doc []byte
+		for len(value) > 0 {
+			var k []byte
+			k, value = readIndexDoc(value)
+			if k == nil {
+				break
+			}
+			k, ok := restoreKey(prefixes, k)
+			if !ok {
+				continue
+			}
+			doc = binary.AppendUvarint(doc, uint64(len(k)))
+			doc = append(doc, k...)
+		}
+		return doc
+	}
+	return value
+}
+
+// readBackupChunk reads a length-prefixed chunk of a backup into buf,
+// growing it if necessary.
+func readBackupChunk(r io.Reader, buf []byte) ([]byte, error) {
+	var size uint64
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
@@ -1,13 +1,24 @@
 package bow
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
 )
 
 type Arrow struct {
@@ -188,7 +199,28 @@ func TestReadOnly(t *testing.T) {
 	defer db2.Drop()
 
 	db2.DontGet("arrows", fmt.Sprint(rand.Intn(math.MaxInt64)))
-	db2.DontGet("arrows2", fmt.Sprint(rand.Intn(math.MaxInt64)))
+	var a0 Arrow
+	err := db2.DB().Bucket("arrows2").Get("1", &a0)
+	if !errors.Is(err, ErrBucketNotFound) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrBucketNotFound for missing bucket, got %v", err)
+	}
+	missing := db2.DB().Bucket("arrows2")
+	if err := missing.Put(a1); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Put, got %v", err)
+	}
+	if err := missing.PutBytes("1", []byte("{}")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from PutBytes, got %v", err)
+	}
+	if err := missing.Delete("1"); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Delete, got %v", err)
+	}
+	if _, err := missing.Count(); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Count, got %v", err)
+	}
+	var found []Arrow
+	if err := missing.Query().Where("Length", Eq, 10).Find(&found); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Find, got %v", err)
+	}
 
 	var a2 Arrow
 	db2.Get("arrows", a1.Id, &a2)
@@ -222,6 +254,2078 @@ func TestReadOnly(t *testing.T) {
 	}
 }
 
+type Secret struct {
+	Id     string `bow:"key"`
+	Name   string
+	Token  string `bow:"encrypt"`
+	Binary []byte `bow:"encrypt"`
+}
+
+// Tests that fields tagged with encrypt are stored encrypted and decrypted
+// by Get and Iter.
+func TestEncrypt(t *testing.T) {
+	key := StaticKey("0123456789abcdef0123456789abcdef")
+	db := OpenTestDB(t, SetKeyProvider(key))
+	defer db.Drop()
+
+	s1 := Secret{Id: "1", Name: "visible", Token: "hunter2", Binary: []byte("shh")}
+	db.Put("secrets", &s1)
+	if s1.Token != "hunter2" || string(s1.Binary) != "shh" {
+		t.Fatal("Put modified the record")
+	}
+
+	raw, err := db.DB().Bucket("secrets").GetBytes("1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "visible") {
+		t.Fatalf("unencrypted field is missing from %s", raw)
+	}
+	if strings.Contains(string(raw), "hunter2") || strings.Contains(string(raw), "shh") {
+		t.Fatalf("encrypted field is stored in plaintext: %s", raw)
+	}
+
+	var got Secret
+	db.Get("secrets", "1", &got)
+	if !reflect.DeepEqual(s1, got) {
+		t.Fatalf("expected %v, got %v", s1, got)
+	}
+
+	iter := db.DB().Bucket("secrets").Iter()
+	defer iter.Close()
+	if !iter.Next(&got) {
+		t.Fatal(iter.Err())
+	}
+	if !reflect.DeepEqual(s1, got) {
+		t.Fatalf("Iter: expected %v, got %v", s1, got)
+	}
+
+	// Encrypted fields copied to another key or bucket can't be decrypted.
+	if err := db.DB().Bucket("secrets").PutBytes("2", raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("secrets").Get("2", &got); err == nil {
+		t.Fatal("expected an error decrypting a record copied to another key")
+	}
+	if err := db.DB().Bucket("stolen").PutBytes("1", raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("stolen").Get("1", &got); err == nil {
+		t.Fatal("expected an error decrypting a record copied to another bucket")
+	}
+
+	db.Close()
+	db2 := db.OpenAgain()
+	defer db2.Close()
+	err = db2.DB().Bucket("secrets").Get("1", &got)
+	if err != ErrNoKeyProvider {
+		t.Fatalf("expected ErrNoKeyProvider, got %v", err)
+	}
+}
+
+// Tests backing up some of the buckets and restoring them into a database
+// which already has other buckets.
+func TestBackup(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+
+	a1 := Arrow{Id: "1", Length: 10}
+	a2 := Arrow{Id: "2", Length: 20}
+	db.Put("arrows", a1)
+	db.Put("ignored", a1)
+
+	var full bytes.Buffer
+	since, err := db.DB().Backup(&full, 0, "arrows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("arrows", a2)
+	var incremental bytes.Buffer
+	_, err = db.DB().Backup(&incremental, since+1, "arrows")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := OpenTestDB(t)
+	defer db2.Drop()
+	q := Quiver{Id: 1}
+	db2.Put("quivers", q)
+	for _, r := range []io.Reader{&full, &incremental} {
+		if err := db2.DB().Restore(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got Arrow
+	db2.Get("arrows", a1.Id, &got)
+	if !reflect.DeepEqual(a1, got) {
+		t.Fatalf("expected %v, got %v", a1, got)
+	}
+	db2.Get("arrows", a2.Id, &got)
+	if !reflect.DeepEqual(a2, got) {
+		t.Fatalf("expected %v, got %v", a2, got)
+	}
+	var gotQ Quiver
+	db2.Get("quivers", q.Id, &gotQ)
+	if !reflect.DeepEqual(q, gotQ) {
+		t.Fatalf("expected %v, got %v", q, gotQ)
+	}
+	buckets := db2.DB().Buckets()
+	if !reflect.DeepEqual(buckets, []string{"arrows", "quivers"}) {
+		t.Fatalf("unexpected buckets after restore: %v", buckets)
+	}
+	if _, ok := db2.DB().LookupBucket("ignored"); ok {
+		t.Fatal("expected bucket ignored not to be restored")
+	}
+	if b, ok := db2.DB().LookupBucket("arrows"); !ok || b.Get(a1.Id, &got) != nil {
+		t.Fatal("expected to look up bucket arrows")
+	}
+	if buckets := db2.DB().Buckets(); len(buckets) != 2 {
+		t.Fatalf("expected LookupBucket not to create buckets, got %v", buckets)
+	}
+}
+
+// Tests that indexes are restored along with the records.
+func TestBackupIndexes(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	db.Put("articles", Article{Id: "1", Title: "Fletching", Body: "Feathers steady an arrow."})
+	db.Put("devices", Device{Id: "haifa", Location: Point{32.794, 34.9896}})
+	db.Put("members", Member{Id: "ada", City: "London"})
+	db.Put("writers", Writer{"ursula", "Ursula"})
+	db.Put("sessions", Session{Id: "s1", WriterId: "ursula"})
+	db.Put("reviews", Review{Id: "r1", WriterId: "ursula"})
+	var backup bytes.Buffer
+	if _, err := db.DB().Backup(&backup, 0, "articles", "devices", "members", "writers", "sessions"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets are created in a different order, so that their ids differ.
+	db2 := OpenTestDB(t)
+	defer db2.Drop()
+	db2.Put("quivers", Quiver{Id: 1})
+	db2.Put("sessions", Session{Id: "s2"})
+	// Records that the backup overwrites lose their stale index entries.
+	db2.Put("articles", Article{Id: "1", Title: "Nocking", Body: "Feathers"})
+	db2.Put("devices", Device{Id: "haifa", Location: Point{32.0853, 34.7818}})
+	if err := db2.DB().Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := db2.DB().Bucket("articles").Search("nocking", 0); err != nil || len(matches) != 0 {
+		t.Fatalf("expected no stale matches, got %v, %v", matches, err)
+	}
+	if near, err := db2.DB().Bucket("devices").Near(32.0853, 34.7818, 5000); err != nil || len(near) != 0 {
+		t.Fatalf("expected no stale devices, got %v, %v", near, err)
+	}
+
+	matches, err := db2.DB().Bucket("articles").Search("feathers", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || string(matches[0].Key) != "1" {
+		t.Fatalf("expected article 1, got %v", matches)
+	}
+	near, err := db2.DB().Bucket("devices").Near(32.79, 34.99, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(near) != 1 || string(near[0].Key) != "haifa" {
+		t.Fatalf("expected device haifa, got %v", near)
+	}
+	var members []Member
+	if err := db2.DB().Bucket("members").Query().Where("City", Eq, "London").Find(&members); err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Id != "ada" {
+		t.Fatalf("expected member ada, got %v", members)
+	}
+
+	// References between restored buckets are restored, so deleting Ursula
+	// deletes her session, but her review wasn't backed up to restrict it.
+	if err := db2.DB().Bucket("writers").Delete("ursula"); err != nil {
+		t.Fatal(err)
+	}
+	db2.DontGet("sessions", "s1")
+	db2.Get("sessions", "s2", new(Session))
+}
+
+// Tests exporting buckets to JSON Lines and importing them back.
+func TestExportImport(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+
+	a1 := Arrow{Id: "123", Length: 10, Sharpness: 0.97}
+	a2 := Arrow{Id: "456", Length: 15, Sharpness: 0.98}
+	db.Put("arrows", a1)
+	db.Put("arrows", a2)
+	armory := Armory{Id: NewId(), Quivers: []Quiver{{Id: 1, Arrows: []Arrow{a1}}}}
+	db.Put("armories", armory)
+
+	var arrows, armories bytes.Buffer
+	if err := db.DB().Bucket("arrows").Export(&arrows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("armories").Export(&armories); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(arrows.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"key":"123","value":{`) {
+		t.Fatalf("unexpected export:\n%s", arrows.String())
+	}
+	if !strings.Contains(armories.String(), armory.Id.String()) {
+		t.Fatalf("expected key %s in export:\n%s", armory.Id, armories.String())
+	}
+
+	exported := arrows.String()
+	err := db.DB().Bucket("arrows2").Import(&arrows, func() interface{} { return new(Arrow) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB().Bucket("arrows3").Import(strings.NewReader(exported), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB().Bucket("armories2").Import(&armories, func() interface{} { return new(Armory) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Arrow
+	db.Get("arrows2", a2.Id, &got)
+	if !reflect.DeepEqual(a2, got) {
+		t.Fatalf("expected %v, got %v", a2, got)
+	}
+	db.Get("arrows3", a1.Id, &got)
+	if !reflect.DeepEqual(a1, got) {
+		t.Fatalf("expected %v, got %v", a1, got)
+	}
+	var gotArmory Armory
+	db.Get("armories2", armory.Id, &gotArmory)
+	if !reflect.DeepEqual(armory, gotArmory) {
+		t.Fatalf("expected %v, got %v", armory, gotArmory)
+	}
+
+	// Records with an empty key are given a new Id, like PutBytes does.
+	unkeyed := db.DB().Bucket("unkeyed")
+	fixture := `{"key":"","value":{"Length":1}}
+{"key":"","value":{"Length":2}}
+`
+	if err := unkeyed.Import(strings.NewReader(fixture), nil); err != nil {
+		t.Fatal(err)
+	}
+	var lengths []int
+	for rec, err := range unkeyed.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Key()) != len(NewId()) {
+			t.Fatalf("expected an Id key, got %q", rec.Key())
+		}
+		if err := rec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, got.Length)
+	}
+	if len(lengths) != 2 {
+		t.Fatalf("expected 2 records, got %v", lengths)
+	}
+}
+
+// Tests that records written by Import and PutBytes are indexed.
+func TestImportIndexes(t *testing.T) {
+	db := OpenTestDB(t, SetBucketType("typed", Member{}))
+	defer db.Drop()
+	londoners := func(bucket string) []string {
+		var found []Member
+		err := db.DB().Bucket(bucket).Query().Where("City", Eq, "London").Find(&found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range found {
+			ids = append(ids, m.Id)
+		}
+		return ids
+	}
+	fixture := `{"key":"ada","value":{"Name":"Ada","City":"London"}}
+{"key":"grace","value":{"Name":"Grace","City":"New York"}}
+`
+	err := db.DB().Bucket("imported").Import(strings.NewReader(fixture), func() interface{} { return new(Member) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := londoners("imported"); !reflect.DeepEqual(got, []string{"ada"}) {
+		t.Fatalf("expected [ada] from Import, got %v", got)
+	}
+
+	// Without newType, records are indexed by the bucket's type.
+	if err := db.DB().Bucket("typed").Import(strings.NewReader(fixture), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("typed").PutBytes("alan", []byte(`{"Name":"Alan","City":"London"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := londoners("typed"); !reflect.DeepEqual(got, []string{"ada", "alan"}) {
+		t.Fatalf("expected [ada alan] from Import and PutBytes, got %v", got)
+	}
+
+	// Without a type, PutBytes removes the record's stale indexes.
+	if err := db.DB().Bucket("imported").PutBytes("ada", []byte(`{"Name":"Ada","City":"Paris"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := londoners("imported"); got != nil {
+		t.Fatalf("expected no londoners after PutBytes, got %v", got)
+	}
+}
+
+// Tests that operations respect cancelled contexts.
+func TestContext(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+
+	a1 := Arrow{Id: "1", Length: 10}
+	a2 := Arrow{Id: "2", Length: 20}
+	db.Put("arrows", a1)
+	db.Put("arrows", a2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := bucket.IterContext(ctx)
+	defer iter.Close()
+	var got Arrow
+	if !iter.Next(&got) {
+		t.Fatal(iter.Err())
+	}
+	cancel()
+	if iter.Next(&got) {
+		t.Fatal("Next returned a record after cancel")
+	}
+	if iter.Err() != context.Canceled {
+		t.Fatalf("expected context.Canceled from Err, got %v", iter.Err())
+	}
+
+	if err := bucket.GetContext(ctx, a1.Id, &got); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from Get, got %v", err)
+	}
+	a3 := Arrow{Id: "3"}
+	if err := bucket.PutContext(ctx, a3); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from Put, got %v", err)
+	}
+	if err := bucket.DeleteContext(ctx, a1.Id); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from Delete, got %v", err)
+	}
+	db.DontGet("arrows", a3.Id)
+	db.Get("arrows", a1.Id, &got)
+}
+
+func TestTyped(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	arrows := Typed[Arrow](db.DB(), "arrows")
+
+	a1 := Arrow{Id: "1", Length: 10, Sharpness: 0.5}
+	a2 := Arrow{Id: "2", Length: 20, Sharpness: 0.7}
+	for _, a := range []Arrow{a1, a2} {
+		if err := arrows.Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := arrows.Get(a1.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a1, got) {
+		t.Fatalf("expected %v, got %v", a1, got)
+	}
+	if _, err := arrows.Get("3"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	var all []Arrow
+	for a, err := range arrows.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, a)
+	}
+	if !reflect.DeepEqual(all, []Arrow{a1, a2}) {
+		t.Fatalf("expected %v, got %v", []Arrow{a1, a2}, all)
+	}
+
+	if err := arrows.Delete(a1.Id); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("arrows", a1.Id)
+
+	// Invalid types are rejected by every operation.
+	type floatKey struct {
+		Id float64 `bow:"key"`
+	}
+	if err := Typed[floatKey](db.DB(), "floats").Put(floatKey{}); err == nil {
+		t.Fatal("expected error from Put with an invalid key type")
+	}
+	if _, err := Typed[*Arrow](db.DB(), "arrows").Get(a2.Id); err == nil {
+		t.Fatal("expected error from Get with a pointer type")
+	}
+}
+
+func TestSeq(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+
+	arrows := []Arrow{{Id: "a1", Length: 1}, {Id: "a2", Length: 2}, {Id: "b1", Length: 3}}
+	for _, a := range arrows {
+		db.Put("arrows", a)
+	}
+
+	var all []Arrow
+	for rec, err := range bucket.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var a Arrow
+		if err := rec.Decode(&a); err != nil {
+			t.Fatal(err)
+		}
+		if string(rec.Key()) != a.Id {
+			t.Fatalf("expected key %q, got %q", a.Id, rec.Key())
+		}
+		all = append(all, a)
+	}
+	if !reflect.DeepEqual(all, arrows) {
+		t.Fatalf("expected %v, got %v", arrows, all)
+	}
+
+	var keys []string
+	for key, err := range bucket.PrefixKeys("a") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(key))
+	}
+	if !reflect.DeepEqual(keys, []string{"a1", "a2"}) {
+		t.Fatalf("expected keys [a1 a2], got %v", keys)
+	}
+
+	// Breaking early stops the iteration.
+	n := 0
+	for _, err := range bucket.Keys() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		break
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 iteration, got %d", n)
+	}
+
+	for _, err := range bucket.PrefixSeq(1.5) {
+		if err == nil {
+			t.Fatal("expected error from an invalid prefix")
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+
+	t1 := db.DB().Namespace("tenant-1")
+	t2 := db.DB().Namespace("tenant-2")
+	a1 := Arrow{Id: "1", Length: 10}
+	a2 := Arrow{Id: "1", Length: 20}
+	if err := t1.Bucket("arrows").Put(a1); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Bucket("arrows").Put(a2); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Namespace("archive").Bucket("arrows").Put(a1); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("arrows", a1)
+
+	var got Arrow
+	if err := t2.Bucket("arrows").Get("1", &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a2, got) {
+		t.Fatalf("expected %v, got %v", a2, got)
+	}
+
+	// Namespaces don't consume bucket ids.
+	if buckets := db.DB().Buckets(); !reflect.DeepEqual(buckets, []string{"arrows"}) {
+		t.Fatalf("expected buckets [arrows], got %v", buckets)
+	}
+	names, err := db.DB().Namespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"tenant-1", "tenant-2"}) {
+		t.Fatalf("expected namespaces [tenant-1 tenant-2], got %v", names)
+	}
+	names, err = t2.Namespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"archive"}) {
+		t.Fatalf("expected namespaces [archive], got %v", names)
+	}
+
+	if err := t2.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Bucket("arrows").Delete("1"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound from dropped namespace, got %v", err)
+	}
+	if _, err := t2.Buckets(); !errors.Is(err, ErrNamespaceNotFound) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound, got %v", err)
+	}
+	names, err = db.DB().Namespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"tenant-1"}) {
+		t.Fatalf("expected namespaces [tenant-1], got %v", names)
+	}
+	if err := db.DB().Namespace("tenant-2").Bucket("arrows").Get("1", &got); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after Drop, got %v", err)
+	}
+	if err := t1.Bucket("arrows").Get("1", &got); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("arrows", "1", &got)
+
+	// Namespaces persist.
+	db.Close()
+	db2 := db.OpenAgain(SetReadOnly(true))
+	defer db2.Drop()
+	buckets, err := db2.DB().Namespace("tenant-1").Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(buckets, []string{"arrows"}) {
+		t.Fatalf("expected buckets [arrows], got %v", buckets)
+	}
+	if err := db2.DB().Namespace("tenant-1").Bucket("arrows").Get("1", &got); err != nil {
+		t.Fatal(err)
+	}
+	missing := db2.DB().Namespace("tenant-3")
+	if err := missing.Bucket("arrows").Put(got); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound from Put, got %v", err)
+	}
+	if err := missing.Bucket("arrows").Delete("1"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound from Delete, got %v", err)
+	}
+	if err := missing.Drop(); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound from Drop, got %v", err)
+	}
+	var nsErr *NamespaceError
+	if err := missing.Namespace("archive").Bucket("arrows").Put(got); !errors.As(err, &nsErr) || nsErr.Namespace != "tenant-3" {
+		t.Fatalf("expected NamespaceError of tenant-3, got %v", err)
+	}
+	var bucketErr *BucketError
+	if err := missing.Bucket("arrows").Put(got); !errors.As(err, &bucketErr) || bucketErr.Bucket != "tenant-3/arrows" {
+		t.Fatalf("expected BucketError of tenant-3/arrows, got %v", err)
+	}
+}
+
+type Target struct {
+	Id     string `bow:"key"`
+	Points int
+	Loaded bool `json:"-"`
+}
+
+func (t *Target) BeforePut() error {
+	if t.Points < 0 {
+		return fmt.Errorf("negative points")
+	}
+	if t.Points == 0 {
+		t.Points = 10
+	}
+	return nil
+}
+
+func (t *Target) AfterGet() error {
+	t.Loaded = true
+	return nil
+}
+
+func (t *Target) BeforeDelete(tx *Tx) error {
+	if t.Points > 100 {
+		return fmt.Errorf("target %s is too valuable to delete", t.Id)
+	}
+	return tx.Put("deleted", Arrow{Id: t.Id, Length: t.Points})
+}
+
+func TestHooks(t *testing.T) {
+	db := OpenTestDB(t, SetBucketType("targets", Target{}))
+	defer db.Drop()
+	bucket := db.DB().Bucket("targets")
+
+	// BeforePut sets defaults, even when the record is passed by value.
+	if err := bucket.Put(Target{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	var got Target
+	db.Get("targets", "a", &got)
+	if !reflect.DeepEqual(got, Target{Id: "a", Points: 10, Loaded: true}) {
+		t.Fatalf("expected defaults and AfterGet, got %v", got)
+	}
+
+	// BeforePut errors abort Put.
+	if err := bucket.Put(Target{Id: "b", Points: -1}); err == nil {
+		t.Fatal("expected error from BeforePut")
+	}
+	db.DontGet("targets", "b")
+
+	// BeforeDelete errors abort Delete.
+	if err := bucket.Put(&Target{Id: "c", Points: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete("c"); err == nil {
+		t.Fatal("expected error from BeforeDelete")
+	}
+	db.Get("targets", "c", &got)
+
+	// Changes in BeforeDelete are committed along with Delete.
+	if err := bucket.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("targets", "a")
+	var deleted Arrow
+	db.Get("deleted", "a", &deleted)
+	if deleted.Length != 10 {
+		t.Fatalf("expected length 10, got %d", deleted.Length)
+	}
+
+	// Deleting a missing record doesn't call BeforeDelete.
+	if err := bucket.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Lock struct {
+	Id string `bow:"key"`
+}
+
+// BeforeDelete refuses to delete held locks, and forgets released ones.
+func (l *Lock) BeforeDelete(tx *Tx) error {
+	err := tx.Get("held", l.Id, new(Lock))
+	if err == nil {
+		return fmt.Errorf("lock %s is held", l.Id)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return tx.Delete("released", l.Id)
+}
+
+// Tests that Tx doesn't create buckets to read or delete from.
+func TestTxMissingBucket(t *testing.T) {
+	db := OpenTestDB(t, SetBucketType("locks", Lock{}))
+	defer db.Drop()
+	db.Put("locks", Lock{Id: "a"})
+	if err := db.DB().Bucket("locks").Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("locks", "a")
+	if buckets := db.DB().Buckets(); !reflect.DeepEqual(buckets, []string{"locks"}) {
+		t.Fatalf("expected buckets [locks], got %v", buckets)
+	}
+}
+
+type Post struct {
+	Id      string `bow:"key"`
+	Body    string
+	Created time.Time `bow:"created"`
+	Updated time.Time `bow:"updated"`
+}
+
+func TestTimestamps(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	db := OpenTestDB(t, SetClock(clock))
+	defer db.Drop()
+	bucket := db.DB().Bucket("posts")
+
+	p := Post{Id: "1", Body: "first"}
+	if err := bucket.Put(&p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Created.Equal(now) || !p.Updated.Equal(now) {
+		t.Fatalf("expected timestamps %v, got %v and %v", now, p.Created, p.Updated)
+	}
+
+	// Updating keeps the creation time, even if it isn't given.
+	created := now
+	now = now.Add(time.Hour)
+	if err := bucket.Put(Post{Id: "1", Body: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	var got Post
+	db.Get("posts", "1", &got)
+	if !got.Created.Equal(created) {
+		t.Fatalf("expected created %v, got %v", created, got.Created)
+	}
+	if !got.Updated.Equal(now) {
+		t.Fatalf("expected updated %v, got %v", now, got.Updated)
+	}
+
+	type invalid struct {
+		Id      string `bow:"key"`
+		Created string `bow:"created"`
+	}
+	if err := bucket.Put(invalid{Id: "2"}); err == nil {
+		t.Fatal("expected error from Put with a non-time created field")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	db := OpenTestDB(t, SetHistory("arrows", 3), SetClock(clock))
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+
+	for length := 1; length <= 4; length++ {
+		db.Put("arrows", Arrow{Id: "a", Length: length})
+		now = now.Add(time.Minute)
+	}
+	if err := bucket.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := bucket.History("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("expected 3 revisions, got %d", len(revs))
+	}
+	if !revs[0].Deleted {
+		t.Fatal("expected newest revision to be a deletion")
+	}
+	if !revs[0].Time.Equal(now) {
+		t.Fatalf("expected time %v, got %v", now, revs[0].Time)
+	}
+	var got Arrow
+	if err := revs[1].Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Length != 4 {
+		t.Fatalf("expected length 4, got %d", got.Length)
+	}
+
+	// Restore an old revision.
+	if err := bucket.GetAt("a", revs[2].Version, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Length != 3 {
+		t.Fatalf("expected length 3, got %d", got.Length)
+	}
+	if err := bucket.GetAt("a", revs[0].Version, &got); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound at deletion, got %v", err)
+	}
+	var keyErr *KeyError
+	if err := revs[0].Decode(&got); !errors.As(err, &keyErr) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected KeyError wrapping ErrNotFound from Decode, got %v", err)
+	}
+	if _, err := bucket.History("nope"); !errors.As(err, &keyErr) || string(keyErr.Key) != "nope" || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected KeyError wrapping ErrNotFound from History, got %v", err)
+	}
+	db.Put("arrows", got)
+	db.Get("arrows", "a", &got)
+
+	db.Put("quivers", Quiver{Id: 1})
+	if _, err := db.DB().Bucket("quivers").History(1); err != ErrNoHistory {
+		t.Fatalf("expected ErrNoHistory, got %v", err)
+	}
+
+	// The history of deleted records survives compaction.
+	db.Put("arrows", Arrow{Id: "b", Length: 1})
+	db.Put("arrows", Arrow{Id: "b", Length: 2})
+	if err := bucket.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db2 := db.OpenAgain(SetHistory("arrows", 3), SetClock(clock))
+	defer db2.Close()
+	if err := db2.DB().Badger().Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	bucket = db2.DB().Bucket("arrows")
+	revs, err = bucket.History("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 || !revs[0].Deleted {
+		t.Fatalf("expected a deletion and 2 revisions, got %+v", revs)
+	}
+	if err := revs[2].Decode(&got); err != nil || got.Length != 1 {
+		t.Fatalf("expected length 1, got %d, %v", got.Length, err)
+	}
+	db2.DontGet("arrows", "b")
+	if n, err := bucket.Count(); err != nil || n != 1 {
+		t.Fatalf("expected 1 record, got %d, %v", n, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+
+	a1 := Arrow{Id: "1", Length: 10}
+	db.Put("arrows", a1)
+	db.Put("quivers", Quiver{Id: 1, Arrows: []Arrow{a1}})
+
+	snap := db.DB().Snapshot()
+	defer snap.Close()
+
+	// Changes after the snapshot aren't visible to it.
+	db.Put("arrows", Arrow{Id: "1", Length: 20})
+	db.Put("arrows", Arrow{Id: "2", Length: 30})
+	if err := db.DB().Bucket("quivers").Delete(1); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Arrow
+	if err := snap.Bucket("arrows").Get("1", &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a1, got) {
+		t.Fatalf("expected %v, got %v", a1, got)
+	}
+	n := 0
+	for _, err := range snap.Bucket("arrows").Keys() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 record in snapshot, got %d", n)
+	}
+	iter := snap.Bucket("quivers").Iter()
+	var q Quiver
+	if !iter.Next(&q) {
+		t.Fatalf("expected deleted quiver in snapshot: %v", iter.Err())
+	}
+	iter.Close()
+
+	if err := snap.Bucket("arrows").Put(a1); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	err := snap.Bucket("swords").Get("1", &got)
+	var bucketErr *BucketError
+	if !errors.As(err, &bucketErr) || bucketErr.Bucket != "swords" || !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected BucketError wrapping ErrBucketNotFound, got %v", err)
+	}
+	if err := snap.Bucket("swords").Put(a1); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Put, got %v", err)
+	}
+	if err := snap.Bucket("swords").Delete("1"); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("expected ErrBucketNotFound from Delete, got %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader := OpenTestDB(t)
+	defer leader.Drop()
+	follower := OpenTestDB(t)
+	defer follower.Drop()
+
+	a1 := Arrow{Id: "1", Length: 10}
+	leader.Put("arrows", a1)
+	leader.Put("arrows", Arrow{Id: "2", Length: 20})
+
+	follow := func() (stop func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- follower.DB().FollowDB(ctx, leader.DB())
+		}()
+		return func() {
+			cancel()
+			if err := <-done; err != context.Canceled {
+				t.Fatalf("expected context.Canceled from FollowDB, got %v", err)
+			}
+		}
+	}
+	// waitFor polls the follower until cond is true.
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for replication")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// exists reads from a Snapshot, which doesn't create the bucket, since
+	// a follower must not be written to.
+	exists := func(key string) bool {
+		snap := follower.DB().Snapshot()
+		defer snap.Close()
+		var a Arrow
+		return snap.Bucket("arrows").Get(key, &a) == nil
+	}
+
+	stop := follow()
+	waitFor(func() bool { return exists("1") && exists("2") })
+	var got Arrow
+	follower.Get("arrows", "1", &got)
+	if !reflect.DeepEqual(a1, got) {
+		t.Fatalf("expected %v, got %v", a1, got)
+	}
+
+	// Changes are streamed as they're committed.
+	if err := leader.DB().Bucket("arrows").Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	leader.Put("arrows", Arrow{Id: "3", Length: 30})
+	waitFor(func() bool { return exists("3") && !exists("2") })
+
+	// Deleted index entries, whose values are empty, are deleted too.
+	leader.Put("members", Member{Id: "ada", City: "London"})
+	leader.Put("members", Member{Id: "ada", City: "Paris"})
+	keys := func(db *DB) []string {
+		var keys []string
+		db.Badger().View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if key := it.Item().Key(); !bytes.Equal(key, replicationKey) {
+					keys = append(keys, string(key))
+				}
+			}
+			return nil
+		})
+		return keys
+	}
+	waitFor(func() bool { return reflect.DeepEqual(keys(leader.DB()), keys(follower.DB())) })
+	stop()
+
+	// Following resumes from the applied version.
+	version, err := follower.DB().ReplicatedVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == 0 {
+		t.Fatal("expected replicated version to be stored")
+	}
+	leader.Put("arrows", Arrow{Id: "4", Length: 40})
+	if err := leader.DB().Namespace("tenant").Bucket("arrows").Put(a1); err != nil {
+		t.Fatal(err)
+	}
+	follower.Close()
+	follower = follower.OpenAgain()
+	stop = follow()
+	waitFor(func() bool { return exists("4") })
+	stop()
+	if err := follower.DB().Namespace("tenant").Bucket("arrows").Get("1", &got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Article struct {
+	Id    string `bow:"key"`
+	Title string `bow:"text"`
+	Body  string `bow:"text"`
+}
+
+func TestSearch(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("articles")
+
+	articles := []Article{
+		{Id: "1", Title: "Sharpening arrows", Body: "How to sharpen an arrow."},
+		{Id: "2", Title: "Quivers", Body: "A quiver holds arrows. Quivers are made of leather."},
+		{Id: "3", Title: "Bows", Body: "The bow is the oldest ranged weapon."},
+	}
+	for _, a := range articles {
+		if err := bucket.Put(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(query string) []string {
+		matches, err := bucket.Search(query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, m := range matches {
+			keys = append(keys, string(m.Key))
+		}
+		return keys
+	}
+
+	// Stemming matches "arrow" with "arrows", and "1" ranks higher for
+	// mentioning arrows more often relative to its length.
+	if got := keys("Arrow"); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("expected [1 2], got %v", got)
+	}
+	if got := keys("the quivers"); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Fatalf("expected [2], got %v", got)
+	}
+	if got := keys("the"); got != nil {
+		t.Fatalf("expected no matches for a stopword, got %v", got)
+	}
+
+	// Updates and deletes maintain the index.
+	articles[2].Body = "A bow shoots arrows."
+	if err := bucket.Put(articles[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys("oldest"); got != nil {
+		t.Fatalf("expected no matches after update, got %v", got)
+	}
+	if err := bucket.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys("arrows"); len(got) != 2 || got[0] == "1" || got[1] == "1" {
+		t.Fatalf("expected [2 3] in any order, got %v", got)
+	}
+
+	matches, err := bucket.Search("arrows bow", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || string(matches[0].Key) != "3" {
+		t.Fatalf("expected best match 3, got %v", matches)
+	}
+	var got Article
+	db.Get("articles", matches[0].Key, &got)
+	if !reflect.DeepEqual(got, articles[2]) {
+		t.Fatalf("expected %v, got %v", articles[2], got)
+	}
+
+	// Imported records are indexed too.
+	bucket = db.DB().Bucket("imported")
+	fixture := `{"key":"1","value":{"Title":"Fletching","Body":"Feathers steady an arrow."}}
+{"key":"2","value":{"Title":"Strings","Body":"Bowstrings are made of linen."}}
+`
+	err = bucket.Import(strings.NewReader(fixture), func() interface{} { return new(Article) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys("feathers"); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Fatalf("expected [1] from Import, got %v", got)
+	}
+
+	// Stats searched while records are put and deleted concurrently agree
+	// with the index.
+	bucket = db.DB().Bucket("concurrent")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			a := Article{Id: strconv.Itoa(i), Title: "Arrow", Body: strings.Repeat("arrow ", i)}
+			if err := bucket.Put(a); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%5 == 0 {
+				if err := bucket.Delete(a.Id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if _, err := bucket.Search("arrow", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := textStats{}
+	for i := 0; i < 50; i++ {
+		if i%5 != 0 {
+			want.docs++
+			want.totalLen += 1 + i
+		}
+	}
+	err = db.DB().db.View(func(txn *badger.Txn) error {
+		got, err := bucket.textStats(txn)
+		if err == nil && got != want {
+			t.Fatalf("expected stats %+v, got %+v", want, got)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type Device struct {
+	Id       string `bow:"key"`
+	Location Point  `bow:"geo"`
+}
+
+func TestGeo(t *testing.T) {
+	if h := geohash(Point{57.64911, 10.40744}, 11); h != "u4pruydqqvj" {
+		t.Fatalf("expected geohash u4pruydqqvj, got %s", h)
+	}
+
+	db := OpenTestDB(t, SetBucketType("typed", Device{}))
+	defer db.Drop()
+	bucket := db.DB().Bucket("devices")
+	devices := []Device{
+		{Id: "telaviv", Location: Point{32.0853, 34.7818}},
+		{Id: "jaffa", Location: Point{32.0504, 34.7522}},
+		{Id: "jerusalem", Location: Point{31.7683, 35.2137}},
+		{Id: "suva", Location: Point{-18.1416, 178.4419}},
+		{Id: "taveuni", Location: Point{-16.8, -179.97}},
+	}
+	for _, d := range devices {
+		if err := bucket.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(matches []GeoMatch, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, m := range matches {
+			keys = append(keys, string(m.Key))
+		}
+		return keys
+	}
+
+	if got := keys(bucket.Near(32.0853, 34.7818, 5000)); !reflect.DeepEqual(got, []string{"telaviv", "jaffa"}) {
+		t.Fatalf("expected [telaviv jaffa], got %v", got)
+	}
+	if got := keys(bucket.Near(32.0853, 34.7818, 100000)); !reflect.DeepEqual(got, []string{"telaviv", "jaffa", "jerusalem"}) {
+		t.Fatalf("expected [telaviv jaffa jerusalem], got %v", got)
+	}
+	// Across the antimeridian.
+	if got := keys(bucket.Near(-17.5, 179.5, 300000)); !reflect.DeepEqual(got, []string{"taveuni", "suva"}) {
+		t.Fatalf("expected [taveuni suva], got %v", got)
+	}
+	box := Box{MinLat: 31, MinLng: 34, MaxLat: 32.07, MaxLng: 36}
+	if got := keys(bucket.Within(box)); !reflect.DeepEqual(got, []string{"jaffa", "jerusalem"}) {
+		t.Fatalf("expected [jaffa jerusalem], got %v", got)
+	}
+
+	// Moving and deleting maintain the index.
+	devices[0].Location = Point{31.77, 35.21}
+	if err := bucket.Put(devices[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete("jaffa"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(bucket.Near(32.0853, 34.7818, 5000)); got != nil {
+		t.Fatalf("expected no matches, got %v", got)
+	}
+	if got := keys(bucket.Within(box)); !reflect.DeepEqual(got, []string{"jerusalem", "telaviv"}) {
+		t.Fatalf("expected [jerusalem telaviv], got %v", got)
+	}
+
+	// Invalid points are rejected rather than indexed or scanned.
+	if _, err := bucket.Near(0, math.Inf(1), 1000); !errors.Is(err, ErrInvalidPoint) {
+		t.Fatalf("expected ErrInvalidPoint for infinite longitude, got %v", err)
+	}
+	if _, err := bucket.Near(0, 0, math.NaN()); !errors.Is(err, ErrInvalidPoint) {
+		t.Fatalf("expected ErrInvalidPoint for NaN radius, got %v", err)
+	}
+	if _, err := bucket.Within(Box{MinLat: -100, MaxLat: 0, MinLng: 0, MaxLng: 10}); !errors.Is(err, ErrInvalidPoint) {
+		t.Fatalf("expected ErrInvalidPoint for latitude -100, got %v", err)
+	}
+	if err := bucket.Put(Device{Id: "nowhere", Location: Point{100, 0}}); !errors.Is(err, ErrInvalidPoint) {
+		t.Fatalf("expected ErrInvalidPoint from Put, got %v", err)
+	}
+	db.DontGet("devices", "nowhere")
+	if lng := normalizeLng(1e300); lng < -180 || lng > 180 {
+		t.Fatalf("expected normalized longitude, got %v", lng)
+	}
+
+	// Imported records are indexed, and so are those put with PutBytes into
+	// a bucket whose type is set.
+	imported := db.DB().Bucket("imported")
+	fixture := `{"key":"haifa","value":{"Location":{"Lat":32.794,"Lng":34.9896}}}
+`
+	err := imported.Import(strings.NewReader(fixture), func() interface{} { return new(Device) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(imported.Near(32.79, 34.99, 5000)); !reflect.DeepEqual(got, []string{"haifa"}) {
+		t.Fatalf("expected [haifa] from Import, got %v", got)
+	}
+	typed := db.DB().Bucket("typed")
+	if err := typed.PutBytes("eilat", []byte(`{"Location":{"Lat":29.5577,"Lng":34.9519}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(typed.Within(Box{MinLat: 29, MinLng: 34, MaxLat: 30, MaxLng: 35})); !reflect.DeepEqual(got, []string{"eilat"}) {
+		t.Fatalf("expected [eilat] from PutBytes, got %v", got)
+	}
+}
+
+type Sale struct {
+	Id     string `bow:"key"`
+	Region string
+	Amount int
+}
+
+func TestAggregate(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("sales")
+	sales := []Sale{
+		{Id: "2020-01-a", Region: "north", Amount: 10},
+		{Id: "2020-01-b", Region: "south", Amount: 30},
+		{Id: "2020-02-a", Region: "north", Amount: 20},
+		{Id: "2020-03-a", Region: "south", Amount: 5},
+		{Id: "2021-01-a", Region: "north", Amount: 100},
+	}
+	for _, s := range sales {
+		if err := bucket.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(n int, err error) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(bucket.Count()); n != 5 {
+		t.Fatalf("expected 5 records, got %d", n)
+	}
+	if n := count(bucket.CountPrefix("2020-")); n != 4 {
+		t.Fatalf("expected 4 records, got %d", n)
+	}
+	if n := count(bucket.CountRange("2020-02", "2021")); n != 2 {
+		t.Fatalf("expected 2 records, got %d", n)
+	}
+	if n := count(bucket.CountRange(nil, "2020-02")); n != 2 {
+		t.Fatalf("expected 2 records, got %d", n)
+	}
+
+	newSale := func() interface{} { return new(Sale) }
+	stats, err := bucket.Aggregate(newSale, "Amount").Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Stats{Count: 5, Sum: 165, Min: 5, Max: 100}); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	avg, err := bucket.Aggregate(newSale, "Amount").Prefix("2020-").Avg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg != 16.25 {
+		t.Fatalf("expected average 16.25, got %v", avg)
+	}
+	max, err := bucket.Aggregate(newSale, "Amount").Prefix("2020-").Range("2020-02", nil).Max()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max != 20 {
+		t.Fatalf("expected max 20, got %v", max)
+	}
+
+	groups, err := bucket.Aggregate(newSale, "Amount").Prefix("2020-").GroupBy("Region")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[interface{}]Stats{
+		"north": {Count: 2, Sum: 30, Min: 10, Max: 20},
+		"south": {Count: 2, Sum: 35, Min: 5, Max: 30},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected %v, got %v", expected, groups)
+	}
+
+	if _, err := bucket.Aggregate(newSale, "Region").Sum(); err == nil {
+		t.Fatal("expected an error aggregating a string field")
+	}
+
+	// Integers are summed exactly, where adding floats would round 2^53+1
+	// down before adding 1.
+	big := db.DB().Bucket("big sales")
+	for _, s := range []Sale{{Id: "a", Amount: 1<<53 + 1}, {Id: "b", Amount: 1}} {
+		if err := big.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum, err := big.Aggregate(newSale, "Amount").Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 1<<53+2 {
+		t.Fatalf("expected sum %d, got %.0f", 1<<53+2, sum)
+	}
+
+	// Groups that aren't comparable fail rather than panic.
+	type Tagged struct {
+		Id     string `bow:"key"`
+		Tag    interface{}
+		Amount int
+	}
+	tagged := db.DB().Bucket("tagged")
+	for _, v := range []Tagged{{Id: "a", Tag: "x"}, {Id: "b", Tag: []string{"x", "y"}}} {
+		if err := tagged.Put(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = tagged.Aggregate(func() interface{} { return new(Tagged) }, "Amount").GroupBy("Tag")
+	if err == nil || !strings.Contains(err.Error(), "comparable") {
+		t.Fatalf("expected an error grouping by a slice, got %v", err)
+	}
+
+	// Unexported fields fail rather than panic.
+	type private struct {
+		Id     string `bow:"key"`
+		region string
+		amount int
+		Amount int
+	}
+	newPrivate := func() interface{} { return new(private) }
+	if err := tagged.Put(private{Id: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tagged.Aggregate(newPrivate, "Amount").GroupBy("region")
+	if err == nil || !strings.Contains(err.Error(), "no comparable field") {
+		t.Fatalf("expected an error grouping by an unexported field, got %v", err)
+	}
+	_, err = tagged.Aggregate(newPrivate, "amount").Sum()
+	if err == nil || !strings.Contains(err.Error(), "no numeric field") {
+		t.Fatalf("expected an error aggregating an unexported field, got %v", err)
+	}
+}
+
+type Member struct {
+	Id      string `bow:"key"`
+	Name    string
+	Age     int    `bow:"index"`
+	City    string `bow:"index"`
+	Created time.Time
+}
+
+func TestQuery(t *testing.T) {
+	values := []interface{}{-5.5, -1.0, 0.0, 2.0, 1e10}
+	for i := 1; i < len(values); i++ {
+		a := encodeIndexValue(reflect.ValueOf(values[i-1]))
+		b := encodeIndexValue(reflect.ValueOf(values[i]))
+		if bytes.Compare(a, b) >= 0 {
+			t.Fatalf("expected %v to sort before %v", values[i-1], values[i])
+		}
+	}
+	if a, b := escapeIndexValue([]byte("a")), escapeIndexValue([]byte("a\x00")); bytes.Compare(a, b) >= 0 {
+		t.Fatal(`expected "a" to sort before "a\x00"`)
+	}
+
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("members")
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	members := []Member{
+		{Id: "ada", Name: "Ada", Age: 36, City: "London", Created: base.Add(3 * time.Hour)},
+		{Id: "alan", Name: "Alan", Age: 41, City: "London", Created: base.Add(1 * time.Hour)},
+		{Id: "grace", Name: "Grace", Age: 85, City: "New York", Created: base.Add(2 * time.Hour)},
+		{Id: "linus", Name: "Linus", Age: 28, City: "Helsinki", Created: base.Add(5 * time.Hour)},
+		{Id: "margaret", Name: "Margaret", Age: 33, City: "Boston", Created: base.Add(4 * time.Hour)},
+	}
+	for _, m := range members {
+		if err := bucket.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(q *Query) []string {
+		var found []Member
+		if err := q.Find(&found); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range found {
+			ids = append(ids, m.Id)
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		query    *Query
+		expected []string
+	}{
+		// Full scans.
+		{bucket.Query(), []string{"ada", "alan", "grace", "linus", "margaret"}},
+		{bucket.Query().Where("Name", Ne, "Alan").Limit(2), []string{"ada", "grace"}},
+		{bucket.Query().OrderBy("Created").Limit(3), []string{"alan", "grace", "ada"}},
+		{bucket.Query().Where("Created", Gt, base.Add(2*time.Hour)).OrderBy("Created").Reverse(),
+			[]string{"linus", "margaret", "ada"}},
+		// Key ranges.
+		{bucket.Query().Where("Id", Gte, "alan").And("Id", Lt, "linus"), []string{"alan", "grace"}},
+		{bucket.Query().Where("Id", Eq, "grace"), []string{"grace"}},
+		{bucket.Query().Where("Id", Gt, "linus").And("Age", Lt, 30), nil},
+		// Indexes.
+		{bucket.Query().Where("Age", Gt, 30).And("City", Eq, "London"), []string{"ada", "alan"}},
+		{bucket.Query().Where("Age", Gt, 30).OrderBy("Age").Limit(2), []string{"margaret", "ada"}},
+		{bucket.Query().Where("Age", Lte, 36).OrderBy("Age"), []string{"linus", "margaret", "ada"}},
+		{bucket.Query().Where("City", Eq, "Boston"), []string{"margaret"}},
+		{bucket.Query().Where("Age", Gt, 100), nil},
+	} {
+		if got := ids(test.query); !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("expected %v, got %v", test.expected, got)
+		}
+	}
+
+	// Updating and deleting maintain the indexes.
+	members[1].City = "Manchester"
+	if err := bucket.Put(members[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete("ada"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(bucket.Query().Where("City", Eq, "London")); got != nil {
+		t.Fatalf("expected no results, got %v", got)
+	}
+	if got := ids(bucket.Query().Where("City", Gte, "M")); !reflect.DeepEqual(got, []string{"alan", "grace"}) {
+		t.Fatalf("expected [alan grace], got %v", got)
+	}
+
+	// Pointers are fine too.
+	var found []*Member
+	if err := bucket.Query().Where("Age", Eq, 85).Find(&found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != "grace" {
+		t.Fatalf("expected grace, got %v", found)
+	}
+
+	var invalid []Member
+	for _, q := range []*Query{
+		bucket.Query().Where("Nope", Eq, 1),
+		bucket.Query().Where("Age", Eq, "old"),
+		bucket.Query().Where("Age", Eq, 30.5),
+		bucket.Query().OrderBy("Nope"),
+	} {
+		if err := q.Find(&invalid); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+
+	// Unexported fields can't be queried, ordered by or indexed.
+	type post struct {
+		Id      string `bow:"key"`
+		created time.Time
+	}
+	posts := db.DB().Bucket("posts")
+	if err := posts.Put(post{Id: "a", created: base}); err != nil {
+		t.Fatal(err)
+	}
+	var invalidPosts []post
+	for _, q := range []*Query{
+		posts.Query().Where("created", Gt, base),
+		posts.Query().OrderBy("created"),
+	} {
+		if err := q.Find(&invalidPosts); err == nil {
+			t.Fatal("expected an error for an unexported field")
+		}
+	}
+	type indexedPost struct {
+		Id   string `bow:"key"`
+		city string `bow:"index"`
+	}
+	if err := posts.Put(indexedPost{Id: "b"}); err == nil {
+		t.Fatal("expected an error indexing an unexported field")
+	}
+}
+
+type Writer struct {
+	Id   string `bow:"key"`
+	Name string
+}
+
+type Story struct {
+	Id        string `bow:"key"`
+	Title     string
+	WriterId  string   `bow:"ref=writers"`
+	Writer    *Writer  `json:"-"`
+	EditorIds []string `bow:"ref=writers"`
+	Editors   []Writer `json:"-"`
+}
+
+func TestRefs(t *testing.T) {
+	db := OpenTestDB(t, SetRefIntegrity(true))
+	defer db.Drop()
+	writers := db.DB().Bucket("writers")
+	stories := db.DB().Bucket("stories")
+	for _, w := range []Writer{{"ursula", "Ursula"}, {"terry", "Terry"}} {
+		if err := writers.Put(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []Story{
+		{Id: "1", Title: "Earthsea", WriterId: "ursula", EditorIds: []string{"terry"}},
+		{Id: "2", Title: "Discworld", WriterId: "terry", EditorIds: []string{"ursula", "terry"}},
+		{Id: "3", Title: "Anonymous"},
+	} {
+		if err := stories.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Referential integrity.
+	err := stories.Put(Story{Id: "4", WriterId: "nobody"})
+	if !errors.Is(err, ErrMissingRef) {
+		t.Fatalf("expected ErrMissingRef, got %v", err)
+	}
+	err = stories.Put(Story{Id: "4", WriterId: "terry", EditorIds: []string{"nobody"}})
+	if !errors.Is(err, ErrMissingRef) {
+		t.Fatalf("expected ErrMissingRef, got %v", err)
+	}
+
+	var story Story
+	if err := stories.Get("1", &story); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Load(&story, "Writer", "Editors"); err != nil {
+		t.Fatal(err)
+	}
+	if story.Writer == nil || story.Writer.Name != "Ursula" {
+		t.Fatalf("expected writer Ursula, got %v", story.Writer)
+	}
+	if !reflect.DeepEqual(story.Editors, []Writer{{"terry", "Terry"}}) {
+		t.Fatalf("expected editor Terry, got %v", story.Editors)
+	}
+
+	var found []*Story
+	err = stories.Query().Load("Writer", "Editors").Find(&found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("expected 3 stories, got %d", len(found))
+	}
+	if found[1].Writer.Name != "Terry" || len(found[1].Editors) != 2 {
+		t.Fatalf("unexpected refs of story 2: %v %v", found[1].Writer, found[1].Editors)
+	}
+	if found[2].Writer != nil || len(found[2].Editors) != 0 {
+		t.Fatalf("expected no refs of story 3, got %v %v", found[2].Writer, found[2].Editors)
+	}
+	if err := db.DB().Load(&story, "Title"); err == nil {
+		t.Fatal("expected an error loading a field without a ref")
+	}
+
+	// References of a named integer type.
+	type QuiverId int
+	type Bow struct {
+		Id       string     `bow:"key"`
+		QuiverId QuiverId   `bow:"ref=quivers"`
+		Quiver   *Quiver    `json:"-"`
+		SpareIds []QuiverId `bow:"ref=quivers"`
+		Spares   []Quiver   `json:"-"`
+	}
+	quivers := db.DB().Bucket("quivers")
+	for _, q := range []Quiver{{Id: 1}, {Id: 2}} {
+		if err := quivers.Put(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bows := db.DB().Bucket("bows")
+	if err := bows.Put(Bow{Id: "yew", QuiverId: 1, SpareIds: []QuiverId{2}}); err != nil {
+		t.Fatal(err)
+	}
+	err = bows.Put(Bow{Id: "elm", QuiverId: 3})
+	if !errors.Is(err, ErrMissingRef) {
+		t.Fatalf("expected ErrMissingRef, got %v", err)
+	}
+	var bow Bow
+	if err := bows.Get("yew", &bow); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Load(&bow, "Quiver", "Spares"); err != nil {
+		t.Fatal(err)
+	}
+	if bow.Quiver == nil || bow.Quiver.Id != 1 || len(bow.Spares) != 1 || bow.Spares[0].Id != 2 {
+		t.Fatalf("unexpected refs of bow: %v %v", bow.Quiver, bow.Spares)
+	}
+}
+
+type Session struct {
+	Id       string `bow:"key"`
+	WriterId string `bow:"ref=writers,cascade"`
+}
+
+type Token struct {
+	Id        string `bow:"key"`
+	SessionId string `bow:"ref=sessions,cascade"`
+}
+
+type Review struct {
+	Id       string `bow:"key"`
+	WriterId string `bow:"ref=writers,restrict"`
+}
+
+type Draft struct {
+	Id        string   `bow:"key"`
+	WriterId  string   `bow:"ref=writers,nullify"`
+	EditorIds []string `bow:"ref=writers,nullify"`
+}
+
+func TestCascade(t *testing.T) {
+	db := OpenTestDB(t, SetBucketType("drafts", Draft{}))
+	defer db.Drop()
+	// References are kept even before the referenced bucket exists.
+	db.Put("sessions", Session{Id: "s0", WriterId: "ursula"})
+	for _, w := range []Writer{{"ursula", "Ursula"}, {"terry", "Terry"}} {
+		db.Put("writers", w)
+	}
+	db.Put("sessions", Session{Id: "s1", WriterId: "ursula"})
+	db.Put("sessions", Session{Id: "s2", WriterId: "terry"})
+	db.Put("tokens", Token{Id: "t1", SessionId: "s1"})
+	db.Put("reviews", Review{Id: "r1", WriterId: "terry"})
+	db.Put("drafts", Draft{Id: "d1", WriterId: "ursula", EditorIds: []string{"terry", "ursula"}})
+
+	// Deleting Ursula deletes her sessions and their tokens, and removes her
+	// from drafts.
+	if err := db.DB().Bucket("writers").Delete("ursula"); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("sessions", "s0")
+	db.DontGet("sessions", "s1")
+	db.DontGet("tokens", "t1")
+	var session Session
+	db.Get("sessions", "s2", &session)
+	var draft Draft
+	db.Get("drafts", "d1", &draft)
+	if draft.WriterId != "" || !reflect.DeepEqual(draft.EditorIds, []string{"terry"}) {
+		t.Fatalf("expected Ursula to be removed from the draft, got %+v", draft)
+	}
+
+	// Terry is restricted by a review, so nothing is deleted.
+	err := db.DB().Bucket("writers").Delete("terry")
+	var depErr *DependentsError
+	if !errors.As(err, &depErr) {
+		t.Fatalf("expected a DependentsError, got %v", err)
+	}
+	expected := []Dependent{{Bucket: "reviews", Field: "WriterId", Key: []byte("r1")}}
+	if !reflect.DeepEqual(depErr.Dependents, expected) {
+		t.Fatalf("expected dependents %v, got %v", expected, depErr.Dependents)
+	}
+	var w Writer
+	db.Get("writers", "terry", &w)
+	db.Get("sessions", "s2", &session)
+
+	// Once the review is deleted, so is Terry.
+	if err := db.DB().Bucket("reviews").Delete("r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("writers").Delete("terry"); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("sessions", "s2")
+	db.Get("drafts", "d1", &draft)
+	if len(draft.EditorIds) != 0 {
+		t.Fatalf("expected no editors, got %v", draft.EditorIds)
+	}
+
+	// Imported records are dependents too.
+	db.Put("writers", Writer{"octavia", "Octavia"})
+	err = db.DB().Bucket("reviews").Import(strings.NewReader(`{"key":"r2","value":{"WriterId":"octavia"}}`+"\n"),
+		func() interface{} { return new(Review) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB().Bucket("sessions").Import(strings.NewReader(`{"key":"s3","value":{"WriterId":"octavia"}}`+"\n"),
+		func() interface{} { return new(Session) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DB().Bucket("writers").Delete("octavia")
+	if !errors.As(err, &depErr) || len(depErr.Dependents) != 1 || string(depErr.Dependents[0].Key) != "r2" {
+		t.Fatalf("expected review r2 to restrict the delete, got %v", err)
+	}
+	if err := db.DB().Bucket("reviews").Delete("r2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB().Bucket("writers").Delete("octavia"); err != nil {
+		t.Fatal(err)
+	}
+	db.DontGet("sessions", "s3")
+
+	// Nullifying references requires the bucket's type, so Put fails without
+	// it rather than Delete.
+	err = db.DB().Bucket("untyped drafts").Put(Draft{Id: "d2", WriterId: "terry"})
+	if err == nil || !strings.Contains(err.Error(), "SetBucketType") {
+		t.Fatalf("expected Put to require SetBucketType, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// Fails operations on key "fail" after they're done, aborting their
+	// transactions.
+	errFail := errors.New("fail")
+	fail := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		if err := next(call); err != nil {
+			return err
+		}
+		if string(call.Key) == "fail" && call.Kind != CallGet {
+			return errFail
+		}
+		return nil
+	})
+	db := OpenTestDB(t, SetInterceptors(fail))
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+	for i := 0; i < 3; i++ {
+		if err := bucket.Put(Arrow{Id: strconv.Itoa(i), Length: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Aborted puts and deletes aren't counted.
+	if err := bucket.PutBytes("fail", []byte("{}")); !errors.Is(err, errFail) {
+		t.Fatalf("expected the interceptor's error, got %v", err)
+	}
+	if err := bucket.Delete("fail"); !errors.Is(err, errFail) {
+		t.Fatalf("expected the interceptor's error, got %v", err)
+	}
+	var a Arrow
+	if err := bucket.Get("1", &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Get("nope", &a); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := bucket.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	iter := bucket.Iter()
+	for iter.Next(&a) {
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets in namespaces are counted together.
+	for _, tenant := range []string{"tenant-1", "tenant-2"} {
+		if err := db.DB().Namespace(tenant).Bucket("arrows").Put(Arrow{Id: "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metrics := db.DB().Metrics()
+	if n := metrics.Buckets["*/arrows"].Puts; n != 2 {
+		t.Fatalf("expected 2 puts in */arrows, got %d", n)
+	}
+	if _, ok := metrics.Buckets["tenant-1/arrows"]; ok {
+		t.Fatal("expected no metrics of tenant-1/arrows")
+	}
+
+	m := metrics.Buckets["arrows"]
+	if m.Puts != 3 || m.Gets != 2 || m.Misses != 1 || m.Deletes != 1 || m.Iterated != 2 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+	if m.BytesEncoded == 0 || m.BytesDecoded == 0 {
+		t.Fatalf("expected bytes to be counted, got %+v", m)
+	}
+	// Latencies include aborted operations.
+	if m.PutLatency.Count != 4 || m.PutLatency.Counts[len(m.PutLatency.Counts)-1] > 4 {
+		t.Fatalf("unexpected put latency %+v", m.PutLatency)
+	}
+
+	rec := httptest.NewRecorder()
+	db.DB().MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`bow_puts_total{bucket="arrows"} 3`,
+		`bow_misses_total{bucket="arrows"} 1`,
+		`bow_operation_duration_seconds_count{bucket="arrows",op="get"} 2`,
+		`# TYPE bow_lsm_size_bytes gauge`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Fatalf("expected %q in:\n%s", line, rec.Body.String())
+		}
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(db.DB().MetricsVar().String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v["Buckets"]; !ok {
+		t.Fatalf("expected Buckets in %v", v)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	var calls []string
+	audit := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		calls = append(calls, fmt.Sprintf("%s %s %s", call.Kind, call.Bucket, call.Key))
+		return next(call)
+	})
+	// envelope wraps persisted values in brackets, and unwraps retrieved ones.
+	envelope := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		if call.Kind == CallPut {
+			call.Value = append(append([]byte("["), call.Value...), ']')
+		}
+		if err := next(call); err != nil {
+			return err
+		}
+		if call.Kind == CallGet || call.Kind == CallIterate && call.Value != nil {
+			call.Value = call.Value[1 : len(call.Value)-1]
+		}
+		return nil
+	})
+	errDenied := errors.New("denied")
+	guard := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		if call.Kind == CallDelete && string(call.Key) == "0" {
+			return errDenied
+		}
+		if call.Kind == CallIterate && string(call.Key) == "1" {
+			return ErrSkip
+		}
+		return next(call)
+	})
+	db := OpenTestDB(t, SetInterceptors(audit, envelope, guard))
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+	for i := 0; i < 3; i++ {
+		if err := bucket.Put(Arrow{Id: strconv.Itoa(i), Length: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, err := bucket.GetBytes("2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a Arrow
+	if err := bucket.Get("2", &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Length != 2 {
+		t.Fatalf("expected length 2, got %d", a.Length)
+	}
+	if raw[0] == '[' {
+		t.Fatalf("expected value to be unwrapped, got %s", raw)
+	}
+
+	var lengths []int
+	iter := bucket.Iter()
+	for iter.Next(&a) {
+		lengths = append(lengths, a.Length)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lengths, []int{0, 2}) {
+		t.Fatalf("expected lengths [0 2], got %v", lengths)
+	}
+	if n, err := bucket.Count(); err != nil || n != 2 {
+		t.Fatalf("expected count 2, got %d, %v", n, err)
+	}
+
+	if err := bucket.Delete("0"); err != errDenied {
+		t.Fatalf("expected errDenied, got %v", err)
+	}
+	if err := bucket.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("arrows", "0", &a)
+	db.DontGet("arrows", "2")
+
+	expected := []string{
+		"put arrows 0", "put arrows 1", "put arrows 2",
+		"get arrows 2", "get arrows 2",
+		"iterate arrows 0", "iterate arrows 1", "iterate arrows 2",
+		"iterate arrows 0", "iterate arrows 1", "iterate arrows 2",
+		"delete arrows 0", "delete arrows 2",
+		"get arrows 0", "get arrows 2",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %q, got %q", expected, calls)
+	}
+
+	// Indexes match values replaced by interceptors.
+	relocate := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		if call.Kind == CallPut {
+			call.Value = bytes.Replace(call.Value, []byte("London"), []byte("Paris"), -1)
+		}
+		return next(call)
+	})
+	db2 := OpenTestDB(t, SetInterceptors(relocate))
+	defer db2.Drop()
+	members := db2.DB().Bucket("members")
+	if err := members.Put(Member{Id: "ada", Name: "Ada", City: "London"}); err != nil {
+		t.Fatal(err)
+	}
+	for city, n := range map[string]int{"London": 0, "Paris": 1} {
+		var found []Member
+		if err := members.Query().Where("City", Eq, city).Find(&found); err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != n {
+			t.Fatalf("expected %d members in %s, got %v", n, city, found)
+		}
+	}
+
+	// Queries on indexed fields and exports iterate through interceptors.
+	redact := InterceptorFunc(func(call *Call, next func(call *Call) error) error {
+		if call.Kind == CallIterate && string(call.Key) == "alan" {
+			return ErrSkip
+		}
+		if err := next(call); err != nil {
+			return err
+		}
+		call.Value = bytes.Replace(call.Value, []byte("Ada"), []byte("***"), -1)
+		return nil
+	})
+	db3 := OpenTestDB(t, SetInterceptors(redact))
+	defer db3.Drop()
+	members = db3.DB().Bucket("members")
+	for _, m := range []Member{{Id: "ada", Name: "Ada", City: "London"}, {Id: "alan", City: "London"}} {
+		if err := members.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, field := range []string{"Id", "City"} {
+		var found []Member
+		err := members.Query().Where(field, Gte, "").Where("City", Eq, "London").Find(&found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].Id != "ada" || found[0].Name != "***" {
+			t.Fatalf("%s: expected only ada redacted, got %v", field, found)
+		}
+	}
+	var buf bytes.Buffer
+	if err := members.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Count(out, "\n") != 1 || strings.Contains(out, "Ada") {
+		t.Fatalf("expected only ada to be exported redacted, got %s", out)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	dir := tempfile("bow-")
+	db, err := Open(dir, SetInMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("arrows").Put(Arrow{Id: "1", Length: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var a Arrow
+	if err := db.Bucket("arrows").Get("1", &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s not to exist, got %v", dir, err)
+	}
+}
+
+func TestValueLogGC(t *testing.T) {
+	db := OpenTestDB(t, SetValueLogGC(GCOptions{Interval: 10 * time.Millisecond}))
+	defer db.Drop()
+	for i := 0; i < 10; i++ {
+		db.Put("arrows", Arrow{Id: strconv.Itoa(i), Length: i})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.DB().Metrics().GCRuns == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected value log GC to run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if m := db.DB().Metrics(); m.GCErrors != 0 {
+		t.Fatalf("expected no GC errors, got %+v", m)
+	}
+
+	// Outside of quiet hours, GC doesn't run.
+	noon := func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+	quiet := OpenTestDB(t, SetClock(noon), SetValueLogGC(GCOptions{
+		Interval:   time.Millisecond,
+		QuietStart: 22 * time.Hour,
+		QuietEnd:   5 * time.Hour,
+	}))
+	defer quiet.Drop()
+	time.Sleep(50 * time.Millisecond)
+	if runs := quiet.DB().Metrics().GCRuns; runs != 0 {
+		t.Fatalf("expected no GC runs, got %d", runs)
+	}
+
+	for _, c := range []struct {
+		hour, start, end time.Duration
+		quiet            bool
+	}{
+		{3, 2, 5, true},
+		{5, 2, 5, false},
+		{23, 22, 5, true},
+		{1, 22, 5, true},
+		{12, 22, 5, false},
+		{12, 0, 0, true},
+	} {
+		tm := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(c.hour * time.Hour)
+		if got := inQuietHours(tm, c.start*time.Hour, c.end*time.Hour); got != c.quiet {
+			t.Errorf("inQuietHours(%v, %v, %v) = %v", tm, c.start, c.end, got)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db := OpenTestDB(t)
+	defer db.Drop()
+	bucket := db.DB().Bucket("arrows")
+
+	var a Arrow
+	err := bucket.Get("nope", &a)
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected KeyError wrapping ErrNotFound, got %v", err)
+	}
+	if keyErr.Bucket != "arrows" || string(keyErr.Key) != "nope" || keyErr.Op != "get" {
+		t.Fatalf("unexpected KeyError %+v", keyErr)
+	}
+
+	err = bucket.Delete(struct{}{})
+	if !errors.As(err, &keyErr) || keyErr.Op != "delete" || keyErr.Key != nil {
+		t.Fatalf("expected KeyError of invalid key, got %v", err)
+	}
+	invalid := struct{}{}
+	for name, err := range map[string]error{
+		"CountPrefix": func() error { _, err := bucket.CountPrefix(invalid); return err }(),
+		"CountRange":  func() error { _, err := bucket.CountRange(nil, invalid); return err }(),
+		"Aggregate":   func() error { _, err := bucket.Aggregate(nil, "Length").Prefix(invalid).Sum(); return err }(),
+		"PrefixSeq": func() error {
+			for _, err := range bucket.PrefixSeq(invalid) {
+				return err
+			}
+			return nil
+		}(),
+	} {
+		if !errors.As(err, &keyErr) || keyErr.Op != "iterate" || keyErr.Bucket != "arrows" {
+			t.Fatalf("%s: expected KeyError of invalid key, got %v", name, err)
+		}
+	}
+
+	if err := bucket.PutBytes("bad", []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	err = bucket.Get("bad", &a)
+	var codecErr *CodecError
+	if !errors.As(err, &codecErr) || codecErr.Op != "unmarshal" || string(codecErr.Key) != "bad" {
+		t.Fatalf("expected CodecError, got %v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected CodecError not to be ErrNotFound")
+	}
+}
+
 type TestDB struct {
 	t       *testing.T
 	db      *DB
@@ -282,7 +2386,7 @@ func (t *TestDB) Get(bucket string, key, v interface{}) {
 func (t *TestDB) DontGet(bucket string, key interface{}) {
 	var a Arrow
 	err := t.db.Bucket(bucket).Get(key, &a)
-	if err != ErrNotFound {
+	if !errors.Is(err, ErrNotFound) {
 		t.fail(err)
 	}
 }
@@ -0,0 +1,160 @@
+// Package bowtest helps testing code that uses Bow, with in-memory databases,
+// fixtures and assertions.
+package bowtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/zippoxer/bow"
+)
+
+// Open opens an in-memory database with the given options, which is closed
+// when the test and its subtests complete.
+func Open(t testing.TB, options ...bow.Option) *bow.DB {
+	t.Helper()
+	db, err := bow.Open("", append(options, bow.SetInMemory())...)
+	if err != nil {
+		t.Fatalf("bowtest.Open: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("bowtest: closing database: %v", err)
+		}
+	})
+	return db
+}
+
+// Seed puts the records of a JSON fixture into db. The fixture is an object
+// of buckets, each an array of records in the format written by
+// Bucket.Export:
+//
+//	{
+//		"pages": [
+//			{"key": "home", "value": {"Title": "Home"}},
+//			{"key": "about", "value": {"Title": "About"}}
+//		]
+//	}
+//
+// Values are converted from JSON by the database's codec, which must
+// implement codec.JSONTranscoder. Records are indexed if the types of their
+// buckets are set with bow.SetBucketType, which can be passed to Open.
+func Seed(t testing.TB, db *bow.DB, fixture []byte) {
+	t.Helper()
+	var buckets map[string][]json.RawMessage
+	if err := json.Unmarshal(fixture, &buckets); err != nil {
+		t.Fatalf("bowtest.Seed: %v", err)
+	}
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var lines bytes.Buffer
+		for _, rec := range buckets[name] {
+			lines.Write(rec)
+			lines.WriteByte('\n')
+		}
+		if err := db.Bucket(name).Import(&lines, nil); err != nil {
+			t.Fatalf("bowtest.Seed: bucket %s: %v", name, err)
+		}
+	}
+}
+
+// SeedFile is like Seed, but reads the fixture from the named file, such as
+// one in the package's testdata directory.
+func SeedFile(t testing.TB, db *bow.DB, name string) {
+	t.Helper()
+	fixture, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("bowtest.SeedFile: %v", err)
+	}
+	Seed(t, db, fixture)
+}
+
+// Equal reports an error if the records of the named bucket, in key order,
+// aren't deeply equal to want, a slice of structs or of pointers to structs.
+func Equal(t testing.TB, db *bow.DB, bucket string, want interface{}) {
+	t.Helper()
+	wv := reflect.ValueOf(want)
+	if wv.Kind() != reflect.Slice {
+		t.Fatalf("bowtest.Equal: %T is not a slice", want)
+	}
+	elemType := wv.Type().Elem()
+	recordType := elemType
+	if recordType.Kind() == reflect.Ptr {
+		recordType = recordType.Elem()
+	}
+	got := reflect.MakeSlice(wv.Type(), 0, wv.Len())
+	iter := db.Bucket(bucket).Iter()
+	defer iter.Close()
+	for {
+		p := reflect.New(recordType)
+		if !iter.Next(p.Interface()) {
+			break
+		}
+		if elemType.Kind() == reflect.Ptr {
+			got = reflect.Append(got, p)
+		} else {
+			got = reflect.Append(got, p.Elem())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("bowtest.Equal: bucket %s: %v", bucket, err)
+	}
+	if !reflect.DeepEqual(got.Interface(), want) {
+		t.Errorf("bucket %s:\n got: %s\nwant: %s", bucket, format(got.Interface()), format(want))
+	}
+}
+
+// Exists reports an error if the record with the given key doesn't exist in
+// the named bucket.
+func Exists(t testing.TB, db *bow.DB, bucket string, key interface{}) {
+	t.Helper()
+	_, err := db.Bucket(bucket).GetBytes(key, nil)
+	if errors.Is(err, bow.ErrNotFound) {
+		t.Errorf("bucket %s: key %v doesn't exist", bucket, key)
+	} else if err != nil {
+		t.Fatalf("bowtest.Exists: bucket %s: %v", bucket, err)
+	}
+}
+
+// NotExists reports an error if the record with the given key exists in the
+// named bucket.
+func NotExists(t testing.TB, db *bow.DB, bucket string, key interface{}) {
+	t.Helper()
+	_, err := db.Bucket(bucket).GetBytes(key, nil)
+	if err == nil {
+		t.Errorf("bucket %s: key %v exists", bucket, key)
+	} else if !errors.Is(err, bow.ErrNotFound) {
+		t.Fatalf("bowtest.NotExists: bucket %s: %v", bucket, err)
+	}
+}
+
+// Count reports an error if the named bucket doesn't hold n records.
+func Count(t testing.TB, db *bow.DB, bucket string, n int) {
+	t.Helper()
+	got, err := db.Bucket(bucket).Count()
+	if err != nil {
+		t.Fatalf("bowtest.Count: bucket %s: %v", bucket, err)
+	}
+	if got != n {
+		t.Errorf("bucket %s: got %d records, want %d", bucket, got, n)
+	}
+}
+
+// format formats v as indented JSON for failure messages, since pointers are
+// otherwise printed as addresses.
+func format(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,85 @@
+package bowtest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zippoxer/bow"
+)
+
+type Page struct {
+	URL   string `bow:"key"`
+	Title string
+}
+
+func TestSeed(t *testing.T) {
+	db := Open(t)
+	SeedFile(t, db, "testdata/pages.json")
+	Seed(t, db, []byte(`{"pages": [{"key": "blog", "value": {"Title": "Blog"}}]}`))
+
+	if err := db.Bucket("pages").Delete("home"); err != nil {
+		t.Fatal(err)
+	}
+	Count(t, db, "pages", 2)
+	Exists(t, db, "pages", "blog")
+	NotExists(t, db, "pages", "home")
+	Equal(t, db, "pages", []Page{{"about", "About"}, {"blog", "Blog"}})
+	Equal(t, db, "pages", []*Page{{"about", "About"}, {"blog", "Blog"}})
+}
+
+func TestSeedIndexes(t *testing.T) {
+	type Member struct {
+		Id   string `bow:"key"`
+		City string `bow:"index"`
+	}
+	db := Open(t, bow.SetBucketType("members", Member{}))
+	Seed(t, db, []byte(`{"members": [
+		{"key": "ada", "value": {"City": "London"}},
+		{"key": "grace", "value": {"City": "New York"}}
+	]}`))
+	var found []Member
+	if err := db.Bucket("members").Query().Where("City", bow.Eq, "London").Find(&found); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []Member{{"ada", "London"}}) {
+		t.Fatalf("expected ada, got %v", found)
+	}
+}
+
+func TestEqualFails(t *testing.T) {
+	db := Open(t)
+	if err := db.Bucket("pages").Put(Page{"home", "Home"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, assert := range map[string]func(tt testing.TB){
+		"Equal":     func(tt testing.TB) { Equal(tt, db, "pages", []Page{{"home", "Other"}}) },
+		"Count":     func(tt testing.TB) { Count(tt, db, "pages", 2) },
+		"Exists":    func(tt testing.TB) { Exists(tt, db, "pages", "nope") },
+		"NotExists": func(tt testing.TB) { NotExists(tt, db, "pages", "home") },
+	} {
+		tt := &recorder{TB: t}
+		assert(tt)
+		if !tt.failed {
+			t.Errorf("%s didn't fail", name)
+		}
+	}
+}
+
+func TestOpenIsolated(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		db := Open(t, bow.SetRefIntegrity(true))
+		Count(t, db, "pages", 0)
+		if err := db.Bucket("pages").Put(Page{"home", "Home"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// recorder records failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) { r.failed = true }
+func (r *recorder) Fatalf(format string, args ...interface{}) { r.failed = true }
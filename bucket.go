@@ -1,6 +1,11 @@
 package bow
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
 	"github.com/dgraph-io/badger/v2"
 )
 
@@ -8,105 +13,349 @@ type bucketId [bucketIdSize]byte
 
 // Bucket represents a collection of records in the database.
 type Bucket struct {
-	id  bucketId
-	db  *DB
-	err error
+	// prefix prefixes the keys of the bucket's records. It's the bucket's id,
+	// or in a namespace, the namespace's prefix followed by the bucket's id
+	// within it.
+	prefix []byte
+	db     *DB
+	name   string
+	err    error
+
+	// txn is the transaction of the Snapshot the bucket was obtained from,
+	// if any.
+	txn *badger.Txn
 }
 
 // Put persists a record into the bucket. If a record with the same key already
 // exists, then it will be updated.
 func (b *Bucket) Put(v interface{}) error {
-	if b.db.readOnly {
-		return ErrReadOnly
-	}
+	return b.PutContext(context.Background(), v)
+}
+
+// PutContext is like Put, but aborts before committing if ctx is done.
+func (b *Bucket) PutContext(ctx context.Context, v interface{}) error {
 	if b.err != nil {
 		return b.err
 	}
+	if b.readOnly() {
+		return ErrReadOnly
+	}
 	typ, err := newStructType(v, false)
 	if err != nil {
 		return err
 	}
-	key, err := typ.value(v).key()
+	return b.put(ctx, typ, v)
+}
+
+// put persists v, which must be of type typ.
+func (b *Bucket) put(ctx context.Context, typ *structType, v interface{}) error {
+	defer b.metrics().putLatency.observe(time.Now())
+	return b.updateTx(ctx, func(tx *Tx) error {
+		return b.putTxn(tx, typ, v)
+	})
+}
+
+// putTxn persists v, which must be of type typ, within tx.
+func (b *Bucket) putTxn(tx *Tx, typ *structType, v interface{}) error {
+	fields, err := typ.structFields()
 	if err != nil {
 		return err
 	}
+	sv := typ.value(v)
+	if fields.beforePut {
+		v = sv.addr()
+		if err := v.(BeforePutter).BeforePut(); err != nil {
+			return err
+		}
+	}
+	key, err := sv.key()
+	if err != nil {
+		return &KeyError{Bucket: b.name, Op: "put", Err: err}
+	}
+	if len(key) == 0 {
+		key = []byte(NewId())
+	}
+	ik := b.internalKey(key)
+	if fields.created != -1 || fields.updated != -1 {
+		v = sv.addr()
+		err = b.setTimestamps(tx.txn, fields, sv, ik)
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields.encrypt) > 0 {
+		v, err = b.encryptFields(fields.encrypt, key, sv.value)
+		if err != nil {
+			return err
+		}
+	}
 	data, err := b.db.codec.Marshal(v, nil)
 	if err != nil {
+		return &CodecError{Bucket: b.name, Key: key, Op: "marshal", Err: err}
+	}
+	b.metrics().bytesEncoded.Add(uint64(len(data)))
+	return b.putBytesTxn(tx, typ, sv, key, data)
+}
+
+// putBytesTxn persists data, an encoded record of type typ, under key within
+// tx, and indexes it. sv is the record before it was encoded, or nil, in
+// which case the record is decoded to index it. The record is also decoded
+// if an Interceptor may have replaced it, so that its indexes match the
+// persisted value. If typ is nil, the record's indexes are removed.
+func (b *Bucket) putBytesTxn(tx *Tx, typ *structType, sv *structValue, key, data []byte) error {
+	call := &Call{Context: tx.ctx, Kind: CallPut, Bucket: b.name, Key: key, Value: data}
+	return b.db.intercept(call, func(call *Call) error {
+		if typ == nil {
+			return b.putRecord(tx, nil, nil, key, call.Value)
+		}
+		fields, err := typ.structFields()
+		if err != nil {
+			return err
+		}
+		if fields.indexed() && (sv == nil || len(b.db.interceptors) > 0) {
+			sv, err = b.decodeIndexed(typ, key, call.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return b.putRecord(tx, fields, sv, key, call.Value)
+	})
+}
+
+// putRecord persists data under key within tx, and indexes sv, the decoded
+// data, by fields. If fields is nil, the record's indexes are removed.
+func (b *Bucket) putRecord(tx *Tx, fields *structFields, sv *structValue, key, data []byte) error {
+	if fields == nil {
+		for _, unindex := range []func(tx *Tx, key []byte) error{
+			b.unindexText, b.unindexGeo, b.unindexFields, b.unindexRefs,
+		} {
+			if err := unindex(tx, key); err != nil {
+				return err
+			}
+		}
+	} else if err := b.indexRecord(tx, fields, sv, key); err != nil {
 		return err
 	}
-	return b.PutBytes(key, data)
+	tx.afterCommit(func() { b.metrics().puts.Add(1) })
+	return b.set(tx.txn, b.internalKey(key), data)
 }
 
-func (b *Bucket) PutBytes(key interface{}, data []byte) error {
-	if b.db.readOnly {
-		return ErrReadOnly
+// indexRecord checks the references of sv and updates its indexes within
+// tx.
+func (b *Bucket) indexRecord(tx *Tx, fields *structFields, sv *structValue, key []byte) error {
+	if b.db.refIntegrity && len(fields.refs) > 0 {
+		err := b.checkRefs(tx, fields, sv)
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields.text) > 0 {
+		err := b.indexText(tx, fields, sv, key)
+		if err != nil {
+			return err
+		}
 	}
+	if fields.geo != -1 {
+		err := b.indexGeo(tx, fields, sv, key)
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields.index) > 0 {
+		err := b.indexFields(tx, fields, sv, key)
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields.refs) > 0 {
+		err := b.indexRefs(tx, fields, sv, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeIndexed decodes data, a record of type typ with the given key, to
+// index it.
+func (b *Bucket) decodeIndexed(typ *structType, key, data []byte) (*structValue, error) {
+	typ = typ.pointer()
+	v := reflect.New(typ.typ).Interface()
+	err := b.db.codec.Unmarshal(data, v)
+	if err != nil {
+		return nil, &CodecError{Bucket: b.name, Key: key, Op: "unmarshal", Err: err}
+	}
+	sv := typ.value(v)
+	err = sv.setKey(key)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := typ.structFields()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields.encrypt) > 0 {
+		err = b.decryptFields(fields.encrypt, key, sv.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sv, nil
+}
+
+// setTimestamps sets the fields tagged with `bow:"created"` and
+// `bow:"updated"` of the record that's about to be put under ik. The created
+// field is only set if the record doesn't exist yet. Otherwise, if it's
+// zero, it's copied from the existing record.
+func (b *Bucket) setTimestamps(txn *badger.Txn, fields *structFields, sv *structValue, ik []byte) error {
+	now := b.db.now()
+	if fields.updated != -1 {
+		sv.value.Field(fields.updated).Set(reflect.ValueOf(now))
+	}
+	if fields.created == -1 {
+		return nil
+	}
+	item, err := getRecord(txn, ik)
+	if err == badger.ErrKeyNotFound {
+		sv.value.Field(fields.created).Set(reflect.ValueOf(now))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	created := sv.value.Field(fields.created)
+	if !created.Interface().(time.Time).IsZero() {
+		return nil
+	}
+	return item.Value(func(value []byte) error {
+		old := reflect.New(sv.value.Type())
+		err := b.db.codec.Unmarshal(value, old.Interface())
+		if err != nil {
+			return &CodecError{Bucket: b.name, Key: ik[len(b.prefix):], Op: "unmarshal", Err: err}
+		}
+		created.Set(old.Elem().Field(fields.created))
+		return nil
+	})
+}
+
+// PutBytes persists data, an encoded record, under key. If the bucket's type
+// is set with SetBucketType, the record is decoded and indexed like Put does.
+// Otherwise, any indexes of the key are removed, since they can't be computed.
+func (b *Bucket) PutBytes(key interface{}, data []byte) error {
+	return b.PutBytesContext(context.Background(), key, data)
+}
+
+// PutBytesContext is like PutBytes, but aborts before committing if ctx is
+// done.
+func (b *Bucket) PutBytesContext(ctx context.Context, key interface{}, data []byte) error {
 	if b.err != nil {
 		return b.err
 	}
-	keyBytes, err := keyCodec.Marshal(key, nil)
+	if b.readOnly() {
+		return ErrReadOnly
+	}
+	keyBytes, err := b.encodeKey("put", key)
 	if err != nil {
 		return err
 	}
-	var ik []byte
 	if len(keyBytes) == 0 {
-		ik = b.internalKey([]byte(NewId()))
-	} else {
-		ik = b.internalKey(keyBytes)
+		keyBytes = []byte(NewId())
 	}
-	return b.db.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(ik, data)
+	defer b.metrics().putLatency.observe(time.Now())
+	return b.updateTx(ctx, func(tx *Tx) error {
+		return b.putBytesTxn(tx, b.db.bucketTypes[b.name], nil, keyBytes, data)
 	})
 }
 
-// Get retrieves a record from the bucket by key, returning ErrNotFound if
-// it doesn't exist.
+// Get retrieves a record from the bucket by key, returning a KeyError
+// wrapping ErrNotFound if it doesn't exist. Check it with errors.Is.
 func (b *Bucket) Get(key interface{}, v interface{}) error {
+	return b.GetContext(context.Background(), key, v)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done.
+func (b *Bucket) GetContext(ctx context.Context, key interface{}, v interface{}) error {
 	if b.err != nil {
 		return b.err
 	}
-	keyBytes, err := keyCodec.Marshal(key, nil)
+	typ, err := newStructType(v, true)
 	if err != nil {
 		return err
 	}
-	ik := b.internalKey(keyBytes)
-	typ, err := newStructType(v, true)
+	return b.get(ctx, typ, key, v)
+}
+
+// get retrieves the record with the given key into v, a pointer of type typ.
+func (b *Bucket) get(ctx context.Context, typ *structType, key interface{}, v interface{}) error {
+	keyBytes, err := b.encodeKey("get", key)
 	if err != nil {
 		return err
 	}
-	typ.value(v).setKey(keyBytes)
-	return b.db.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(ik)
+	defer b.metrics().getLatency.observe(time.Now())
+	return b.view(ctx, func(txn *badger.Txn) error {
+		return b.getTxn(ctx, txn, typ, keyBytes, v)
+	})
+}
+
+// getTxn retrieves the record with the given key into v, a pointer of type
+// typ, within txn.
+func (b *Bucket) getTxn(ctx context.Context, txn *badger.Txn, typ *structType, key []byte, v interface{}) error {
+	return b.getValue(ctx, txn, key, func(value []byte) error {
+		return b.decode(typ, key, value, v)
+	})
+}
+
+// getValue calls fn with the encoded value of the record with the given key
+// within txn, returning a KeyError wrapping ErrNotFound if it doesn't exist.
+func (b *Bucket) getValue(ctx context.Context, txn *badger.Txn, key []byte, fn func(value []byte) error) error {
+	m := b.metrics()
+	m.gets.Add(1)
+	lookup := func() (*badger.Item, error) {
+		item, err := getRecord(txn, b.internalKey(key))
 		if err == badger.ErrKeyNotFound {
-			return ErrNotFound
+			m.misses.Add(1)
+			return nil, &KeyError{Bucket: b.name, Key: key, Op: "get", Err: ErrNotFound}
 		}
+		return item, err
+	}
+	if len(b.db.interceptors) == 0 {
+		item, err := lookup()
 		if err != nil {
 			return err
 		}
-		return item.Value(func(value []byte) error {
-			return b.db.codec.Unmarshal(value, v)
-		})
+		return item.Value(fn)
+	}
+	call := &Call{Context: ctx, Kind: CallGet, Bucket: b.name, Key: key}
+	err := b.db.intercept(call, func(call *Call) error {
+		item, err := lookup()
+		if err != nil {
+			return err
+		}
+		call.Value, err = item.ValueCopy(nil)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	return fn(call.Value)
 }
 
 func (b *Bucket) GetBytes(key interface{}, in []byte) (out []byte, err error) {
+	return b.GetBytesContext(context.Background(), key, in)
+}
+
+// GetBytesContext is like GetBytes, but returns ctx.Err() if ctx is done.
+func (b *Bucket) GetBytesContext(ctx context.Context, key interface{}, in []byte) (out []byte, err error) {
 	if b.err != nil {
 		return nil, b.err
 	}
-	keyBytes, err := keyCodec.Marshal(key, nil)
+	keyBytes, err := b.encodeKey("get", key)
 	if err != nil {
 		return nil, err
 	}
-	ik := b.internalKey(keyBytes)
-	err = b.db.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(ik)
-		if err == badger.ErrKeyNotFound {
-			return ErrNotFound
-		}
-		if err != nil {
-			return err
-		}
-		return item.Value(func(value []byte) error {
+	defer b.metrics().getLatency.observe(time.Now())
+	err = b.view(ctx, func(txn *badger.Txn) error {
+		return b.getValue(ctx, txn, keyBytes, func(value []byte) error {
 			size := len(value)
 			if size == 0 {
 				return nil
@@ -124,48 +373,218 @@ func (b *Bucket) GetBytes(key interface{}, in []byte) (out []byte, err error) {
 
 // Delete removes a record from the bucket by key.
 func (b *Bucket) Delete(key interface{}) error {
-	if b.db.readOnly {
-		return ErrReadOnly
-	}
+	return b.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but aborts before committing if ctx is done.
+func (b *Bucket) DeleteContext(ctx context.Context, key interface{}) error {
 	if b.err != nil {
 		return b.err
 	}
-	keyBytes, err := keyCodec.Marshal(key, nil)
+	if b.readOnly() {
+		return ErrReadOnly
+	}
+	keyBytes, err := b.encodeKey("delete", key)
 	if err != nil {
 		return err
 	}
-	ik := b.internalKey(keyBytes)
-	return b.db.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(ik)
+	return b.delete(ctx, b.db.bucketTypes[b.name], keyBytes)
+}
+
+// delete removes the record with the given key. If typ isn't nil, it's the
+// type of the record, which is retrieved first if it has a BeforeDelete hook.
+func (b *Bucket) delete(ctx context.Context, typ *structType, key []byte) error {
+	defer b.metrics().deleteLatency.observe(time.Now())
+	return b.updateTx(ctx, func(tx *Tx) error {
+		return b.deleteTxn(tx, typ, key)
+	})
+}
+
+// deleteTxn is like delete, but within tx.
+func (b *Bucket) deleteTxn(tx *Tx, typ *structType, key []byte) error {
+	call := &Call{Context: tx.ctx, Kind: CallDelete, Bucket: b.name, Key: key}
+	return b.db.intercept(call, func(*Call) error {
+		return b.deleteRecord(tx, typ, key)
 	})
 }
 
+// deleteRecord deletes the record with the given key within tx, along with
+// its indexes and dependents.
+func (b *Bucket) deleteRecord(tx *Tx, typ *structType, key []byte) error {
+	if typ != nil {
+		fields, err := typ.structFields()
+		if err != nil {
+			return err
+		}
+		if fields.beforeDelete {
+			v := reflect.New(typ.typ).Interface()
+			err := b.getTxn(tx.ctx, tx.txn, typ.pointer(), key, v)
+			switch {
+			case err == nil:
+				err = v.(BeforeDeleter).BeforeDelete(tx)
+				if err != nil {
+					return err
+				}
+			case errors.Is(err, ErrNotFound):
+			default:
+				return err
+			}
+		}
+	}
+	err := b.deleteDependents(tx, key)
+	if err != nil {
+		return err
+	}
+	err = b.unindexText(tx, key)
+	if err != nil {
+		return err
+	}
+	err = b.unindexGeo(tx, key)
+	if err != nil {
+		return err
+	}
+	err = b.unindexFields(tx, key)
+	if err != nil {
+		return err
+	}
+	err = b.unindexRefs(tx, key)
+	if err != nil {
+		return err
+	}
+	tx.afterCommit(func() { b.metrics().deletes.Add(1) })
+	return b.del(tx.txn, b.internalKey(key))
+}
+
 // Iter returns an iterator for all the records in the bucket.
 func (b *Bucket) Iter() *Iter {
+	return b.IterContext(context.Background())
+}
+
+// IterContext is like Iter, but the iterator stops when ctx is done, and
+// Err returns ctx.Err().
+func (b *Bucket) IterContext(ctx context.Context) *Iter {
 	if b.err != nil {
 		return &Iter{err: b.err}
 	}
-	iter := newIter(b, nil)
+	iter := newIter(ctx, b, nil)
 	return iter
 }
 
 // Prefix returns an iterator for all the records whose key has the given prefix.
 func (b *Bucket) Prefix(prefix interface{}) *Iter {
+	return b.PrefixContext(context.Background(), prefix)
+}
+
+// PrefixContext is like Prefix, but the iterator stops when ctx is done, and
+// Err returns ctx.Err().
+func (b *Bucket) PrefixContext(ctx context.Context, prefix interface{}) *Iter {
 	if b.err != nil {
 		return &Iter{err: b.err}
 	}
-	key, err := keyCodec.Marshal(prefix, nil)
+	key, err := b.encodeKey("iterate", prefix)
 	if err != nil {
 		return &Iter{err: err}
 	}
-	iter := newIter(b, key)
+	iter := newIter(ctx, b, key)
 	return iter
 }
 
-// internalKey returns key prefixed with the bucket's id.
+// readOnly reports whether the bucket rejects changes, either because the
+// database is read-only or because it was obtained from a Snapshot.
+func (b *Bucket) readOnly() bool {
+	return b.db.readOnly || b.txn != nil
+}
+
+// view runs fn in a read-only transaction, or in the transaction of the
+// bucket's Snapshot, unless ctx is already done.
+func (b *Bucket) view(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.txn != nil {
+		return fn(b.txn)
+	}
+	return b.db.db.View(fn)
+}
+
+// readTxn returns the transaction of the bucket's Snapshot, or a new
+// read-only transaction, in which case discard is true.
+func (b *Bucket) readTxn() (txn *badger.Txn, discard bool) {
+	if b.txn != nil {
+		return b.txn, false
+	}
+	return b.db.db.NewTransaction(false), true
+}
+
+// update runs fn in a read-write transaction, which is discarded instead of
+// committed if ctx is done by the time fn returns.
+func (b *Bucket) update(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.readOnly() {
+		return ErrReadOnly
+	}
+	err := b.db.db.Update(func(txn *badger.Txn) error {
+		if err := fn(txn); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if err == badger.ErrConflict {
+		b.metrics().conflicts.Add(1)
+	}
+	return err
+}
+
+// updateTx is like update, but passes fn a Tx, whose commit hooks are called
+// once it's committed.
+func (b *Bucket) updateTx(ctx context.Context, fn func(tx *Tx) error) error {
+	var tx *Tx
+	err := b.update(ctx, func(txn *badger.Txn) error {
+		tx = &Tx{db: b.db, txn: txn, ctx: ctx}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	tx.committed()
+	return nil
+}
+
+// decode unmarshals data into v, a pointer of type typ, sets its key field
+// and decrypts its encrypted fields.
+func (b *Bucket) decode(typ *structType, key, data []byte, v interface{}) error {
+	b.metrics().bytesDecoded.Add(uint64(len(data)))
+	err := b.db.codec.Unmarshal(data, v)
+	if err != nil {
+		return &CodecError{Bucket: b.name, Key: key, Op: "unmarshal", Err: err}
+	}
+	sv := typ.value(v)
+	err = sv.setKey(key)
+	if err != nil {
+		return err
+	}
+	fields, err := typ.structFields()
+	if err != nil {
+		return err
+	}
+	if len(fields.encrypt) > 0 {
+		err = b.decryptFields(fields.encrypt, key, sv.value)
+		if err != nil {
+			return err
+		}
+	}
+	if fields.afterGet {
+		return sv.addr().(AfterGetter).AfterGet()
+	}
+	return nil
+}
+
+// internalKey returns key prefixed with the bucket's prefix.
 func (b *Bucket) internalKey(key []byte) []byte {
-	buf := make([]byte, len(key)+bucketIdSize)
-	copy(buf, b.id[:])
-	copy(buf[bucketIdSize:], key)
+	buf := make([]byte, len(key)+len(b.prefix))
+	copy(buf, b.prefix)
+	copy(buf[len(b.prefix):], key)
 	return buf
 }
@@ -0,0 +1,330 @@
+package bow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Prefix reserved for the references of fields tagged with
+// `bow:"ref=bucket,cascade"`, `bow:"ref=bucket,restrict"` or
+// `bow:"ref=bucket,nullify"`, so that Delete finds the records referencing
+// the deleted record.
+//
+// The references are prefixed with refPrefix followed by a bucket's prefix:
+//
+//	'r' uvarint(len(key)) key field 0x00 prefix source -> refEntry
+//	'd' key                                            -> the record's 'r' keys
+//
+// An 'r' key is prefixed with the referenced bucket's prefix, and ends with
+// the prefix of the referencing bucket and the key of the referencing record.
+// A 'd' key is prefixed with the referencing bucket's prefix.
+var refPrefix = []byte{reserved, 0x09}
+
+// refAction is what Delete does to the records referencing a deleted record.
+type refAction byte
+
+const (
+	refNoAction refAction = iota
+	refCascade
+	refRestrict
+	refNullify
+)
+
+// Dependent is a record that references another record.
+type Dependent struct {
+	Bucket string
+	Field  string
+	Key    []byte
+}
+
+// DependentsError is returned by Delete when the deleted record is referenced
+// by fields tagged with `bow:"ref=bucket,restrict"`.
+type DependentsError struct {
+	Bucket     string
+	Key        []byte
+	Dependents []Dependent
+}
+
+func (e *DependentsError) Error() string {
+	deps := make([]string, len(e.Dependents))
+	for i, d := range e.Dependents {
+		deps[i] = fmt.Sprintf("%s.%s of key %q", d.Bucket, d.Field, d.Key)
+	}
+	return fmt.Sprintf("bow: key %q in bucket %s is referenced by %s",
+		e.Key, e.Bucket, strings.Join(deps, ", "))
+}
+
+// refEntry is a reference to a record, by a field of a record in another
+// bucket.
+type refEntry struct {
+	action refAction
+	prefix []byte // Prefix of the referencing bucket.
+	bucket string // Name of the referencing bucket.
+	field  string
+	key    []byte
+}
+
+func (e *refEntry) marshal() []byte {
+	b := []byte{byte(e.action)}
+	for _, s := range [][]byte{e.prefix, []byte(e.bucket), []byte(e.field), e.key} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+func (e *refEntry) unmarshal(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("bow: empty reference")
+	}
+	e.action = refAction(b[0])
+	b = b[1:]
+	var bucket, field []byte
+	for _, s := range []*[]byte{&e.prefix, &bucket, &field, &e.key} {
+		*s, b = readIndexDoc(b)
+		if *s == nil {
+			return fmt.Errorf("bow: malformed reference")
+		}
+	}
+	e.bucket, e.field = string(bucket), string(field)
+	return nil
+}
+
+// indexRefs updates the references of the record with the given key, to the
+// fields of sv tagged with `bow:"ref=bucket"` and an action, within tx.
+func (b *Bucket) indexRefs(tx *Tx, fields *structFields, sv *structValue, key []byte) error {
+	err := b.unindexRefs(tx, key)
+	if err != nil {
+		return err
+	}
+	var doc []byte
+	for _, ref := range fields.refs {
+		if ref.onDelete == refNoAction {
+			continue
+		}
+		field := sv.value.Type().Field(ref.index).Name
+		if ref.onDelete == refNullify && b.db.bucketTypes[b.name] == nil {
+			return nullifyWithoutType(field, b.name)
+		}
+		// The referenced bucket is created if it doesn't exist yet, so that
+		// its records are found to be referenced once they're put.
+		target := b.db.Bucket(ref.bucket)
+		if target.err != nil {
+			return target.err
+		}
+		keys, err := refKeys(sv.value.Field(ref.index))
+		if err != nil {
+			return err
+		}
+		e := refEntry{
+			action: ref.onDelete,
+			prefix: b.prefix,
+			bucket: b.name,
+			field:  field,
+			key:    key,
+		}
+		for _, targetKey := range keys {
+			k := target.refKey(targetKey, e.field, b.prefix, key)
+			err = tx.txn.Set(k, e.marshal())
+			if err != nil {
+				return err
+			}
+			doc = binary.AppendUvarint(doc, uint64(len(k)))
+			doc = append(doc, k...)
+		}
+	}
+	if doc == nil {
+		return nil
+	}
+	return tx.txn.Set(b.refDocKey(key), doc)
+}
+
+// unindexRefs removes the references of the record with the given key within
+// tx.
+func (b *Bucket) unindexRefs(tx *Tx, key []byte) error {
+	entries, err := b.refEntries(tx.txn, key)
+	if err != nil {
+		return err
+	}
+	return deleteKeys(tx.txn, entries)
+}
+
+// refEntries returns the keys of the references of the record with the given
+// key within txn, including its doc.
+func (b *Bucket) refEntries(txn *badger.Txn, key []byte) ([][]byte, error) {
+	docKey := b.refDocKey(key)
+	item, err := txn.Get(docKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]byte{docKey}
+	for len(doc) > 0 {
+		var k []byte
+		k, doc = readIndexDoc(doc)
+		if k == nil {
+			break
+		}
+		entries = append(entries, k)
+	}
+	return entries, nil
+}
+
+// deleteDependents deletes or nullifies the records referencing the record
+// with the given key, within tx, or returns a DependentsError if any of them
+// restrict its deletion.
+func (b *Bucket) deleteDependents(tx *Tx, key []byte) error {
+	prefix := b.refKey(key, "", nil, nil)
+	var entries []refEntry
+	it := tx.txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var e refEntry
+		err := it.Item().Value(e.unmarshal)
+		if err != nil {
+			it.Close()
+			return err
+		}
+		entries = append(entries, e)
+	}
+	it.Close()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Restrictions are checked first, so that nothing is deleted in vain.
+	var restricted []Dependent
+	for _, e := range entries {
+		if e.action != refRestrict {
+			continue
+		}
+		source := &Bucket{db: b.db, prefix: e.prefix, name: e.bucket}
+		_, err := getRecord(tx.txn, source.internalKey(e.key))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		restricted = append(restricted, Dependent{Bucket: e.bucket, Field: e.field, Key: e.key})
+	}
+	if len(restricted) > 0 {
+		return &DependentsError{Bucket: b.name, Key: key, Dependents: restricted}
+	}
+
+	// References are removed before dependents are deleted, so that cycles
+	// of references end.
+	for _, e := range entries {
+		err := tx.txn.Delete(b.refKey(key, e.field, e.prefix, e.key))
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		source := &Bucket{db: b.db, prefix: e.prefix, name: e.bucket}
+		var err error
+		switch e.action {
+		case refCascade:
+			_, err = getRecord(tx.txn, source.internalKey(e.key))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = source.deleteTxn(tx, b.db.bucketTypes[e.bucket], e.key)
+		case refNullify:
+			err = source.nullifyRef(tx, e.field, e.key, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullifyRef removes the reference to target from the named field of the
+// record with the given key within tx. The record's type must be set with
+// SetBucketType.
+func (b *Bucket) nullifyRef(tx *Tx, field string, key, target []byte) error {
+	typ := b.db.bucketTypes[b.name]
+	if typ == nil {
+		return nullifyWithoutType(field, b.name)
+	}
+	typ = typ.pointer()
+	v := reflect.New(typ.typ)
+	err := b.getTxn(tx.ctx, tx.txn, typ, key, v.Interface())
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f := v.Elem().FieldByName(field)
+	if !f.IsValid() {
+		return nil
+	}
+	if !isRefSlice(f.Type()) {
+		f.Set(reflect.Zero(f.Type()))
+	} else {
+		kept := reflect.MakeSlice(f.Type(), 0, f.Len())
+		for i := 0; i < f.Len(); i++ {
+			k, err := marshalRef(f.Index(i))
+			if err != nil {
+				return err
+			}
+			if string(k) != string(target) {
+				kept = reflect.Append(kept, f.Index(i))
+			}
+		}
+		f.Set(kept)
+	}
+	return b.putTxn(tx, typ, v.Interface())
+}
+
+// nullifyWithoutType returns the error of nullifying the named field of
+// records in a bucket whose type isn't set with SetBucketType.
+func nullifyWithoutType(field, bucket string) error {
+	return fmt.Errorf(
+		"bow: can't nullify %s of records in bucket %s without SetBucketType",
+		field, bucket)
+}
+
+// refKey returns the key of a reference to the record with the given key,
+// by the named field of the record with key source in the bucket with prefix
+// sourcePrefix. Without a field, it returns the prefix of all references to
+// the record.
+func (b *Bucket) refKey(key []byte, field string, sourcePrefix, source []byte) []byte {
+	k := make([]byte, 0, len(refPrefix)+len(b.prefix)+len(key)+len(field)+
+		len(sourcePrefix)+len(source)+binary.MaxVarintLen64+3)
+	k = append(k, refPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'r')
+	k = binary.AppendUvarint(k, uint64(len(key)))
+	k = append(k, key...)
+	if field == "" {
+		return k
+	}
+	k = append(k, field...)
+	k = append(k, 0)
+	k = append(k, sourcePrefix...)
+	return append(k, source...)
+}
+
+func (b *Bucket) refDocKey(key []byte) []byte {
+	k := make([]byte, 0, len(refPrefix)+len(b.prefix)+len(key)+1)
+	k = append(k, refPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'd')
+	return append(k, key...)
+}
@@ -0,0 +1,262 @@
+// Command bow inspects and modifies Bow databases.
+//
+// Usage:
+//
+//	bow [flags] <command> <dir> [arguments]
+//
+// Commands:
+//
+//	buckets                   list the buckets
+//	count <bucket>            count the records in a bucket
+//	get <bucket> <key>        print a record as JSON
+//	put <bucket> <key> [json] put a record from JSON, read from stdin if omitted
+//	delete <bucket> <key>     delete a record
+//	dump <bucket>             print a bucket in JSON Lines, as Bucket.Export does
+//	load <bucket>             load the output of dump from stdin
+//	stats                     print the size of the database and its buckets
+//	gc                        run value log garbage collection
+//
+// Read commands open the database in read-only mode.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/zippoxer/bow"
+	"github.com/zippoxer/bow/codec"
+	jsoncodec "github.com/zippoxer/bow/codec/json"
+	msgpcodec "github.com/zippoxer/bow/codec/msgp"
+)
+
+var (
+	codecName    = flag.String("codec", "json", "codec of the database: json or msgp")
+	keyType      = flag.String("key", "string", "type of keys given as arguments: string, id, int or uint")
+	discardRatio = flag.Float64("discard", 0.5, "discard ratio for gc")
+	verbose      = flag.Bool("v", false, "log Badger's messages")
+)
+
+// command describes a subcommand.
+type command struct {
+	args     int
+	readOnly bool
+	run      func(db *bow.DB, tc codec.JSONTranscoder, args []string) error
+}
+
+var commands = map[string]command{
+	"buckets": {0, true, buckets},
+	"count":   {1, true, count},
+	"get":     {2, true, get},
+	"put":     {2, false, put},
+	"delete":  {2, false, del},
+	"dump":    {1, true, dump},
+	"load":    {1, false, load},
+	"stats":   {0, true, stats},
+	"gc":      {0, false, gc},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name, dir, args := flag.Arg(0), flag.Arg(1), flag.Args()[2:]
+	cmd, ok := commands[name]
+	if !ok || len(args) < cmd.args {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(cmd, dir, args); err != nil {
+		fmt.Fprintf(os.Stderr, "bow %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func run(cmd command, dir string, args []string) error {
+	var c codec.Codec
+	switch *codecName {
+	case "json":
+		c = jsoncodec.Codec{}
+	case "msgp":
+		c = msgpcodec.Codec{}
+	default:
+		return fmt.Errorf("unknown codec %q", *codecName)
+	}
+	tc, ok := c.(codec.JSONTranscoder)
+	if !ok {
+		return fmt.Errorf("codec %q can't convert to JSON", *codecName)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	opts := badger.DefaultOptions(dir)
+	if !*verbose {
+		opts.Logger = nil
+	}
+	db, err := bow.Open(dir,
+		bow.SetBadgerOptions(opts),
+		bow.SetCodec(c),
+		bow.SetReadOnly(cmd.readOnly))
+	if err != nil {
+		return err
+	}
+	err = cmd.run(db, tc, args)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: bow [flags] <command> <dir> [arguments]
+
+Commands:
+  buckets                    list the buckets
+  count <bucket>             count the records in a bucket
+  get <bucket> <key>         print a record as JSON
+  put <bucket> <key> [json]  put a record from JSON, read from stdin if omitted
+  delete <bucket> <key>      delete a record
+  dump <bucket>              print a bucket in JSON Lines
+  load <bucket>              load the output of dump from stdin
+  stats                      print the size of the database and its buckets
+  gc                         run value log garbage collection
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// parseKey parses a key argument according to the -key flag.
+func parseKey(s string) (interface{}, error) {
+	switch *keyType {
+	case "string":
+		return s, nil
+	case "id":
+		return bow.ParseId(s)
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "uint":
+		return strconv.ParseUint(s, 10, 64)
+	}
+	return nil, fmt.Errorf("unknown key type %q", *keyType)
+}
+
+func buckets(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	for _, name := range db.Buckets() {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func count(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	n, err := countRecords(db.Bucket(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Println(n)
+	return nil
+}
+
+func countRecords(b *bow.Bucket) (int, error) {
+	n := 0
+	for _, err := range b.Keys() {
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func get(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	key, err := parseKey(args[1])
+	if err != nil {
+		return err
+	}
+	data, err := db.Bucket(args[0]).GetBytes(key, nil)
+	if err != nil {
+		return err
+	}
+	j, err := tc.ToJSON(data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", bytes.TrimSpace(j))
+	return nil
+}
+
+func put(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	key, err := parseKey(args[1])
+	if err != nil {
+		return err
+	}
+	var j []byte
+	if len(args) > 2 {
+		j = []byte(args[2])
+	} else {
+		j, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := tc.FromJSON(j)
+	if err != nil {
+		return err
+	}
+	return db.Bucket(args[0]).PutBytes(key, data)
+}
+
+func del(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	key, err := parseKey(args[1])
+	if err != nil {
+		return err
+	}
+	return db.Bucket(args[0]).Delete(key)
+}
+
+func dump(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	return db.Bucket(args[0]).Export(os.Stdout)
+}
+
+func load(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	return db.Bucket(args[0]).Import(os.Stdin, nil)
+}
+
+func stats(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	lsm, vlog := db.Badger().Size()
+	fmt.Printf("lsm\t%d bytes\n", lsm)
+	fmt.Printf("vlog\t%d bytes\n", vlog)
+	for _, name := range db.Buckets() {
+		n, err := countRecords(db.Bucket(name))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("bucket %s\t%d records\n", name, n)
+	}
+	return nil
+}
+
+func gc(db *bow.DB, tc codec.JSONTranscoder, args []string) error {
+	runs := 0
+	for {
+		err := db.Badger().RunValueLogGC(*discardRatio)
+		if err == badger.ErrNoRewrite {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		runs++
+	}
+	fmt.Printf("rewrote %d value log files\n", runs)
+	return nil
+}
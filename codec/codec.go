@@ -22,6 +22,16 @@ type Codec interface {
 	Format() Format
 }
 
+// JSONTranscoder is the interface implemented by codecs that can convert
+// between their encoding and JSON without knowing the encoded type.
+type JSONTranscoder interface {
+	// ToJSON converts data in the codec's format to JSON.
+	ToJSON(data []byte) ([]byte, error)
+
+	// FromJSON converts JSON to data in the codec's format.
+	FromJSON(data []byte) ([]byte, error)
+}
+
 // Marshaler is the interface implemented
 // by types that can marshal themselves.
 type Marshaler interface {
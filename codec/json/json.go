@@ -2,6 +2,7 @@ package json
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/zippoxer/bow/codec"
 )
@@ -16,6 +17,17 @@ func (c Codec) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+func (c Codec) ToJSON(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c Codec) FromJSON(data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return nil, errors.New("invalid JSON")
+	}
+	return data, nil
+}
+
 func (c Codec) Format() codec.Format {
 	return codec.JSON
 }
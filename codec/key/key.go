@@ -75,8 +75,30 @@ func (c Codec) Unmarshal(data []byte, v interface{}) error {
 		*v = string(data)
 	case *byte:
 		*v = data[0]
-	case *uint16, *uint32, *uint64, *uint, *[]uint16, *[]uint32, *[]uint64, *[]uint,
-		*int8, *int16, *int32, *int64, *int, *[]int8, *[]int16, *[]int32, *[]int64, *[]int:
+	case *uint16, *uint32, *uint64, *int8, *int16, *int32, *int64:
+		// Marshal pads integers with leading zeros, so read the trailing bytes.
+		size := binary.Size(v)
+		if len(data) < size {
+			return fmt.Errorf("key is too short for %T", v)
+		}
+		data = data[len(data)-size:]
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, v); err != nil {
+			return err
+		}
+	case *int:
+		var n int64
+		if err := c.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*v = int(n)
+	case *uint:
+		var n uint64
+		if err := c.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*v = uint(n)
+	case *[]uint16, *[]uint32, *[]uint64, *[]uint,
+		*[]int8, *[]int16, *[]int32, *[]int64, *[]int:
 		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, v); err != nil {
 			return err
 		}
@@ -0,0 +1,55 @@
+package key
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that keys decode to the values they were encoded from, despite the
+// leading zeros that Marshal pads integers with.
+func TestRoundTrip(t *testing.T) {
+	var c Codec
+	for _, v := range []interface{}{
+		"key", []byte("key"), byte(7),
+		int8(-8), int16(-16), int32(-32), int64(-64), int(-1 << 40),
+		uint16(16), uint32(32), uint64(1 << 63), uint(1 << 40),
+	} {
+		data, err := c.Marshal(v, nil)
+		if err != nil {
+			t.Fatalf("Marshal(%T): %v", v, err)
+		}
+		p := reflect.New(reflect.TypeOf(v))
+		if err := c.Unmarshal(data, p.Interface()); err != nil {
+			t.Fatalf("Unmarshal(%T): %v", v, err)
+		}
+		if got := p.Elem().Interface(); !reflect.DeepEqual(got, v) {
+			t.Errorf("%T: got %v, want %v", v, got, v)
+		}
+	}
+}
+
+// Tests that integers sort like their encoded keys, which Badger orders.
+func TestOrder(t *testing.T) {
+	var c Codec
+	prev, err := c.Marshal(uint64(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint64{1, 255, 256, 1 << 32, 1<<64 - 1} {
+		data, err := c.Marshal(n, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) <= string(prev) {
+			t.Fatalf("key of %d doesn't sort after the previous key", n)
+		}
+		prev = data
+	}
+}
+
+func TestUnmarshalShort(t *testing.T) {
+	var n int64
+	if err := (Codec{}).Unmarshal([]byte{1, 2}, &n); err == nil {
+		t.Fatal("expected an error for a key shorter than int64")
+	}
+}
@@ -4,7 +4,9 @@
 package msgp
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 
 	"github.com/tinylib/msgp/msgp"
@@ -51,6 +53,48 @@ func (c Codec) Unmarshal(data []byte, v interface{}) error {
 	return err
 }
 
+func (c Codec) ToJSON(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := msgp.UnmarshalAsJSON(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c Codec) FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return msgp.AppendIntf(nil, fromJSONValue(v))
+}
+
+// fromJSONValue replaces the json.Numbers in v with int64 or float64,
+// which msgp can encode.
+func fromJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromJSONValue(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSONValue(e)
+		}
+	}
+	return v
+}
+
 func (c Codec) Format() codec.Format {
 	return codec.MessagePack
 }
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 
@@ -22,6 +24,8 @@ import (
 var (
 	ErrNotFound = errors.New("Record doesn't exist")
 	ErrReadOnly = errors.New("Put and Delete aren't allowed in read-only mode")
+
+	ErrNoHistory = errors.New("Bucket doesn't keep history")
 )
 
 // version increases when backwards-incompatible change is introduced,
@@ -43,6 +47,12 @@ var (
 
 	// Key reserved for metadata.
 	metaKey = []byte{reserved, 0x01}
+
+	// Sequence reserved for generating namespace ids.
+	namespaceIdSequence = []byte{reserved, 0x02}
+
+	// Prefix reserved for the metadata of namespaces.
+	namespaceMetaPrefix = []byte{reserved, 0x03}
 )
 
 // Dependencies.
@@ -132,6 +142,15 @@ func SetReadOnly(readOnly bool) Option {
 	}
 }
 
+// SetInMemory keeps the database in memory instead of a directory, which is
+// useful for tests. Its contents are lost on Close.
+func SetInMemory() Option {
+	return func(db *DB) error {
+		db.inMemory = true
+		return nil
+	}
+}
+
 func SetCodec(c codec.Codec) Option {
 	return func(db *DB) error {
 		db.codec = c
@@ -139,6 +158,24 @@ func SetCodec(c codec.Codec) Option {
 	}
 }
 
+// SetKeyProvider sets the provider of keys for encrypting fields tagged with
+// `bow:"encrypt"`.
+func SetKeyProvider(kp KeyProvider) Option {
+	return func(db *DB) error {
+		db.keyProvider = kp
+		return nil
+	}
+}
+
+// SetClock sets the function that returns the current time for fields tagged
+// with `bow:"created"` and `bow:"updated"`. It defaults to time.Now.
+func SetClock(now func() time.Time) Option {
+	return func(db *DB) error {
+		db.now = now
+		return nil
+	}
+}
+
 func SetLogger(logger badger.Logger) Option {
 	return func(db *DB) error {
 		db.badgerOptions.Logger = logger
@@ -160,13 +197,28 @@ type DB struct {
 	metaMu   sync.RWMutex
 	bucketId *badger.Sequence
 
+	// namespaces caches the metadata of namespaces by their meta key.
+	// It's guarded by metaMu.
+	namespaces  map[string]*namespaceMeta
+	namespaceId *badger.Sequence
+
 	readOnly      bool
+	inMemory      bool
 	codec         codec.Codec
+	keyProvider   KeyProvider
+	bucketTypes   map[string]*structType
+	history       map[string]int
+	refIntegrity  bool
+	metrics       metrics
+	interceptors  []Interceptor
+	gcOptions     *GCOptions
+	gc            *gc
+	now           func() time.Time
 	badgerOptions badger.Options
 }
 
 // Open opens a database at the given directory. If the directory doesn't exist,
-// then it will be created.
+// then it will be created. The directory is ignored with SetInMemory.
 //
 // Configure the database by passing the result of functions like SetCodec or
 // SetBadgerOptions.
@@ -176,6 +228,8 @@ func Open(dir string, options ...Option) (*DB, error) {
 	db := &DB{
 		badgerOptions: badger.DefaultOptions(dir),
 		codec:         jsoncodec.Codec{},
+		namespaces:    make(map[string]*namespaceMeta),
+		now:           time.Now,
 	}
 
 	// Apply options.
@@ -193,11 +247,23 @@ func Open(dir string, options ...Option) (*DB, error) {
 	}
 
 	// Propagate options down to badgerOptions.
-	if db.badgerOptions.Dir == "" {
-		db.badgerOptions.Dir = dir
+	for _, versions := range db.history {
+		if versions > db.badgerOptions.NumVersionsToKeep {
+			db.badgerOptions.NumVersionsToKeep = versions
+		}
 	}
-	if db.badgerOptions.ValueDir == "" {
-		db.badgerOptions.ValueDir = dir
+	if db.inMemory || db.badgerOptions.InMemory {
+		db.inMemory = true
+		db.badgerOptions.InMemory = true
+		db.badgerOptions.Dir = ""
+		db.badgerOptions.ValueDir = ""
+	} else {
+		if db.badgerOptions.Dir == "" {
+			db.badgerOptions.Dir = dir
+		}
+		if db.badgerOptions.ValueDir == "" {
+			db.badgerOptions.ValueDir = dir
+		}
 	}
 
 	bdb, err := badger.Open(db.badgerOptions)
@@ -222,35 +288,35 @@ func Open(dir string, options ...Option) (*DB, error) {
 		return nil, err
 	}
 
-	if !db.readOnly {
-		db.bucketId, err = db.db.GetSequence(bucketIdSequence, 1e3)
-		if err != nil {
-			return nil, err
-		}
-	}
-
+	db.startGC()
 	return db, nil
 }
 
 // Bucket returns the named bucket, creating it if it doesn't exist.
 // If an error has occurred during creation, it would be returned by
-// any operation on the returned bucket.
+// any operation on the returned bucket as a BucketError. In read-only mode,
+// the error of a bucket that doesn't exist wraps ErrBucketNotFound.
 func (db *DB) Bucket(name string) *Bucket {
 	bucket, ok := db.bucket(name)
 	if !ok {
 		if db.readOnly {
-			return &Bucket{err: ErrNotFound}
+			return &Bucket{db: db, name: name, err: &BucketError{Bucket: name, Op: "open", Err: ErrBucketNotFound}}
 		}
 		bucket, err := db.createBucket(nil, name)
 		if err != nil {
-			return &Bucket{err: err}
+			return &Bucket{db: db, name: name, err: &BucketError{Bucket: name, Op: "create", Err: err}}
 		}
 		return bucket
 	}
 	return bucket
 }
 
-// Buckets returns a list of the names of all the buckets in the DB.
+// LookupBucket returns the named bucket if it exists, without creating it.
+func (db *DB) LookupBucket(name string) (*Bucket, bool) {
+	return db.bucket(name)
+}
+
+// Buckets returns a sorted list of the names of all the buckets in the DB.
 func (db *DB) Buckets() []string {
 	db.metaMu.RLock()
 	defer db.metaMu.RUnlock()
@@ -258,11 +324,18 @@ func (db *DB) Buckets() []string {
 	for name := range db.meta.Buckets {
 		names = append(names, name)
 	}
+	sort.Strings(names)
 	return names
 }
 
+// Codec returns the codec records are serialized with.
+func (db *DB) Codec() codec.Codec {
+	return db.codec
+}
+
 // Badger exposes the internal Badger database.
-// Use it to call Backup, Load or RunValueLogGC.
+// Prefer SetValueLogGC over calling RunValueLogGC, and DB.Backup and DB.Restore over
+// Badger's Backup and Load, which aren't aware of buckets.
 // Do NOT perform Set operations as you may corrupt Bow.
 func (db *DB) Badger() *badger.DB {
 	return db.db
@@ -270,12 +343,19 @@ func (db *DB) Badger() *badger.DB {
 
 // Close releases all database resources.
 func (db *DB) Close() error {
+	db.stopGC()
 	if db.bucketId != nil {
 		err := db.bucketId.Release()
 		if err != nil {
 			return err
 		}
 	}
+	if db.namespaceId != nil {
+		err := db.namespaceId.Release()
+		if err != nil {
+			return err
+		}
+	}
 	return db.db.Close()
 }
 
@@ -287,8 +367,9 @@ func (db *DB) bucket(name string) (*Bucket, bool) {
 		return nil, false
 	}
 	bucket := &Bucket{
-		db: db,
-		id: meta.Id,
+		db:     db,
+		prefix: meta.Id[:],
+		name:   name,
 	}
 	return bucket, true
 }
@@ -299,10 +380,14 @@ func (db *DB) createBucket(txn *badger.Txn, name string) (*Bucket, error) {
 
 	meta, ok := db.meta.Buckets[name]
 	if ok {
-		return &Bucket{db: db, id: meta.Id}, nil
+		return &Bucket{db: db, prefix: meta.Id[:], name: name}, nil
 	}
 
-	nextId, err := db.bucketId.Next()
+	seq, err := db.sequence(&db.bucketId, bucketIdSequence)
+	if err != nil {
+		return nil, err
+	}
+	nextId, err := seq.Next()
 	if err != nil {
 		return nil, err
 	}
@@ -326,7 +411,21 @@ func (db *DB) createBucket(txn *badger.Txn, name string) (*Bucket, error) {
 		return nil, err
 	}
 
-	return &Bucket{db: db, id: id}, err
+	return &Bucket{db: db, prefix: id[:], name: name}, err
+}
+
+// sequence returns the sequence stored under key, leasing it on first use,
+// so that a follower that doesn't create buckets or namespaces doesn't
+// overwrite the sequences it replicates. metaMu must be locked.
+func (db *DB) sequence(seq **badger.Sequence, key []byte) (*badger.Sequence, error) {
+	if *seq == nil {
+		s, err := db.db.GetSequence(key, 1e3)
+		if err != nil {
+			return nil, err
+		}
+		*seq = s
+	}
+	return *seq, nil
 }
 
 func (db *DB) readMeta(txn *badger.Txn) error {
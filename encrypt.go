@@ -0,0 +1,146 @@
+package bow
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+var ErrNoKeyProvider = errors.New("Type has encrypted fields but no KeyProvider is set")
+
+// KeyProvider provides the keys used to encrypt and decrypt fields tagged
+// with `bow:"encrypt"`.
+//
+// Fields are encrypted with AES-GCM. Strings are stored as base64 of the
+// ciphertext, and byte slices are stored as the ciphertext itself. The
+// ciphertext is bound to the bucket, the key of the record and the name of
+// the field, so it can't be decrypted after being copied elsewhere.
+type KeyProvider interface {
+	// Key returns the key of the named bucket. It must be 16, 24 or 32 bytes
+	// long to select AES-128, AES-192 or AES-256.
+	Key(bucket string) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider that returns the same key for every bucket.
+type StaticKey []byte
+
+func (k StaticKey) Key(bucket string) ([]byte, error) {
+	return k, nil
+}
+
+// aead returns the cipher used to encrypt fields in the bucket.
+func (b *Bucket) aead() (cipher.AEAD, error) {
+	if b.db.keyProvider == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := b.db.keyProvider.Key(b.name)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptFields returns a pointer to a copy of the struct v, the record of
+// key, with the given fields encrypted. v itself is left untouched.
+func (b *Bucket) encryptFields(fields []int, key []byte, v reflect.Value) (interface{}, error) {
+	aead, err := b.aead()
+	if err != nil {
+		return nil, err
+	}
+	cp := reflect.New(v.Type())
+	cp.Elem().Set(v)
+	for _, i := range fields {
+		field := cp.Elem().Field(i)
+		if field.Len() == 0 {
+			continue
+		}
+		ad := b.additionalData(key, v.Type().Field(i).Name)
+		if field.Kind() == reflect.String {
+			sealed := seal(aead, []byte(field.String()), ad)
+			field.SetString(base64.StdEncoding.EncodeToString(sealed))
+			continue
+		}
+		sealed := seal(aead, field.Bytes(), ad)
+		field.SetBytes(sealed)
+	}
+	return cp.Interface(), nil
+}
+
+// decryptFields decrypts the given fields of the addressable struct v, the
+// record of key, in place.
+func (b *Bucket) decryptFields(fields []int, key []byte, v reflect.Value) error {
+	aead, err := b.aead()
+	if err != nil {
+		return err
+	}
+	for _, i := range fields {
+		field := v.Field(i)
+		if field.Len() == 0 {
+			continue
+		}
+		ad := b.additionalData(key, v.Type().Field(i).Name)
+		if field.Kind() == reflect.String {
+			sealed, err := base64.StdEncoding.DecodeString(field.String())
+			if err != nil {
+				return fmt.Errorf("bow: decrypting %s.%s: %v",
+					v.Type(), v.Type().Field(i).Name, err)
+			}
+			plain, err := open(aead, sealed, ad)
+			if err != nil {
+				return fmt.Errorf("bow: decrypting %s.%s: %v",
+					v.Type(), v.Type().Field(i).Name, err)
+			}
+			field.SetString(string(plain))
+			continue
+		}
+		plain, err := open(aead, field.Bytes(), ad)
+		if err != nil {
+			return fmt.Errorf("bow: decrypting %s.%s: %v",
+				v.Type(), v.Type().Field(i).Name, err)
+		}
+		field.SetBytes(plain)
+	}
+	return nil
+}
+
+// additionalData returns the data authenticated along with the named field of
+// the record of key: the bucket name, the key and the field name, each
+// prefixed by its length.
+func (b *Bucket) additionalData(key []byte, field string) []byte {
+	ad := make([]byte, 0, 3*binary.MaxVarintLen64+len(b.name)+len(key)+len(field))
+	ad = binary.AppendUvarint(ad, uint64(len(b.name)))
+	ad = append(ad, b.name...)
+	ad = binary.AppendUvarint(ad, uint64(len(key)))
+	ad = append(ad, key...)
+	ad = binary.AppendUvarint(ad, uint64(len(field)))
+	return append(ad, field...)
+}
+
+// seal encrypts plaintext and authenticates it with additionalData,
+// returning the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(fmt.Sprintf("bow.seal: %v", err))
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+// open decrypts the output of seal.
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData)
+}
@@ -0,0 +1,92 @@
+package bow
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBucketNotFound is returned by operations on a bucket that doesn't exist,
+// such as in read-only mode, where Bucket doesn't create buckets.
+var ErrBucketNotFound = errors.New("Bucket doesn't exist")
+
+// KeyError is returned by an operation on a record by key, such as when the
+// record doesn't exist, in which case it wraps ErrNotFound, or when the key
+// can't be encoded.
+type KeyError struct {
+	Bucket string
+	Key    []byte // Encoded key, or nil if it couldn't be encoded.
+	Op     string
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("bow: %s in bucket %s: %v", e.Op, e.Bucket, e.Err)
+	}
+	return fmt.Sprintf("bow: %s key %q in bucket %s: %v", e.Op, e.Key, e.Bucket, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// CodecError is returned when a record can't be marshaled or unmarshaled by
+// the codec. Op is either "marshal" or "unmarshal".
+type CodecError struct {
+	Bucket string
+	Key    []byte
+	Op     string
+	Err    error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("bow: %s key %q in bucket %s: %v", e.Op, e.Key, e.Bucket, e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// BucketError is returned by operations on a bucket that couldn't be opened
+// or created, such as when it doesn't exist, in which case it wraps
+// ErrBucketNotFound.
+type BucketError struct {
+	Bucket string
+	Op     string
+	Err    error
+}
+
+func (e *BucketError) Error() string {
+	return fmt.Sprintf("bow: %s bucket %s: %v", e.Op, e.Bucket, e.Err)
+}
+
+func (e *BucketError) Unwrap() error {
+	return e.Err
+}
+
+// NamespaceError is returned by operations on a namespace that couldn't be
+// opened or created, such as when it doesn't exist, in which case it wraps
+// ErrNamespaceNotFound. Namespace is the namespace's path.
+type NamespaceError struct {
+	Namespace string
+	Op        string
+	Err       error
+}
+
+func (e *NamespaceError) Error() string {
+	return fmt.Sprintf("bow: %s namespace %s: %v", e.Op, e.Namespace, e.Err)
+}
+
+func (e *NamespaceError) Unwrap() error {
+	return e.Err
+}
+
+// encodeKey encodes key for the named operation, returning a KeyError if it
+// can't be encoded.
+func (b *Bucket) encodeKey(op string, key interface{}) ([]byte, error) {
+	keyBytes, err := keyCodec.Marshal(key, nil)
+	if err != nil {
+		return nil, &KeyError{Bucket: b.name, Op: op, Err: err}
+	}
+	return keyBytes, nil
+}
@@ -0,0 +1,204 @@
+package bow
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zippoxer/bow/codec"
+)
+
+// exportRecord is a line in the output of Export.
+type exportRecord struct {
+	Key    string          `json:"key"`
+	Binary bool            `json:"binary,omitempty"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Export writes the records in the bucket to w in JSON Lines format, one
+// object per record holding its key and value.
+//
+// Printable keys are written as is. Other keys, such as Id, are written in
+// the form of Id.String and marked with "binary": true.
+//
+// Values are converted to JSON by the codec, which must implement
+// codec.JSONTranscoder. Fields tagged with `bow:"encrypt"` remain encrypted.
+// Records are passed through the interceptors of an iteration, like All.
+func (b *Bucket) Export(w io.Writer) error {
+	if b.err != nil {
+		return b.err
+	}
+	tc, ok := b.db.codec.(codec.JSONTranscoder)
+	if !ok {
+		return fmt.Errorf("bow.Export: codec %T can't convert to JSON", b.db.codec)
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var encErr error
+	err := b.iterate(keyRange{}, false, func(r *Record) bool {
+		var rec exportRecord
+		rec.Key, rec.Binary = FormatKey(r.Key())
+		encErr = r.valueFunc(func(value []byte) error {
+			var err error
+			rec.Value, err = tc.ToJSON(value)
+			if err != nil {
+				return err
+			}
+			return enc.Encode(rec)
+		})
+		return encErr == nil
+	})
+	if err == nil {
+		err = encErr
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import reads records written by Export from r and puts them into the
+// bucket in batches. Each value is decoded from JSON into the result of
+// newType, which must be a pointer to a struct, and encoded with the
+// bucket's codec.
+//
+// If newType is nil, values are converted from JSON by the codec, which must
+// implement codec.JSONTranscoder, and records are decoded into the bucket's
+// type if it's set with SetBucketType.
+//
+// Records are indexed like Put does, and records with an empty key are given
+// a new Id, but hooks aren't called and timestamps aren't set, since they
+// were when the records were exported. Fields tagged
+// with `bow:"encrypt"` are expected to be encrypted already, as written by
+// Export, and are imported as is.
+func (b *Bucket) Import(r io.Reader, newType func() interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.readOnly() {
+		return ErrReadOnly
+	}
+	tc, ok := b.db.codec.(codec.JSONTranscoder)
+	if newType == nil && !ok {
+		return fmt.Errorf("bow.Import: codec %T can't convert from JSON", b.db.codec)
+	}
+	typ := b.db.bucketTypes[b.name]
+	if newType != nil {
+		var err error
+		typ, err = newStructType(newType(), true)
+		if err != nil {
+			return err
+		}
+	}
+	var batch []importRecord
+	var size int
+	flush := func() error {
+		err := b.updateTx(context.Background(), func(tx *Tx) error {
+			for _, rec := range batch {
+				err := b.putBytesTxn(tx, typ, rec.sv, rec.key, rec.data)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch, size = batch[:0], 0
+		return err
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var rec exportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key, err := ParseKey(rec.Key, rec.Binary)
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			key = []byte(NewId())
+		}
+		imported := importRecord{key: key}
+		if newType == nil {
+			imported.data, err = tc.FromJSON(rec.Value)
+			if err != nil {
+				return err
+			}
+		} else {
+			v := newType()
+			err = json.Unmarshal(rec.Value, v)
+			if err != nil {
+				return err
+			}
+			imported.sv = typ.value(v)
+			err = imported.sv.setKey(key)
+			if err != nil {
+				return err
+			}
+			imported.data, err = b.db.codec.Marshal(v, nil)
+			if err != nil {
+				return &CodecError{Bucket: b.name, Key: key, Op: "marshal", Err: err}
+			}
+		}
+		batch = append(batch, imported)
+		size += len(key) + len(imported.data)
+		if len(batch) >= importBatchSize || size >= importBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return flush()
+}
+
+// Import commits a batch once it holds importBatchSize records or
+// importBatchBytes bytes, keeping transactions well below Badger's limits.
+const (
+	importBatchSize  = 1000
+	importBatchBytes = 4 << 20
+)
+
+// importRecord is a record read by Import.
+type importRecord struct {
+	key  []byte
+	data []byte
+	sv   *structValue // The decoded record, or nil if newType is nil.
+}
+
+// FormatKey returns key as a string if it's printable, or otherwise in the
+// form of Id.String, in which case binary is true.
+func FormatKey(key []byte) (s string, binary bool) {
+	if utf8.Valid(key) {
+		printable := true
+		for _, r := range string(key) {
+			if !unicode.IsPrint(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return string(key), false
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(key), true
+}
+
+// ParseKey parses the output of FormatKey.
+func ParseKey(s string, binary bool) ([]byte, error) {
+	if binary {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
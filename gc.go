@@ -0,0 +1,135 @@
+package bow
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// GCOptions configures the garbage collection of Badger's value log by
+// SetValueLogGC.
+type GCOptions struct {
+	// Interval is the time between collections. It defaults to 10 minutes.
+	Interval time.Duration
+
+	// DiscardRatio is the fraction of a value log file that must be stale
+	// for the file to be rewritten. It defaults to 0.5.
+	DiscardRatio float64
+
+	// QuietStart and QuietEnd are the times of day, as durations since
+	// midnight in the clock's location, between which collections run, such
+	// as 2am to 5am. The window may wrap around midnight. If they're equal,
+	// collections run at any time.
+	QuietStart, QuietEnd time.Duration
+}
+
+// SetValueLogGC collects garbage in Badger's value log in the background,
+// so that disk space of deleted and overwritten records is reclaimed. Each
+// collection rewrites files until none is stale enough, and is reported to
+// the logger and counted by Metrics. It stops on Close, and doesn't run in
+// read-only or in-memory mode.
+func SetValueLogGC(o GCOptions) Option {
+	return func(db *DB) error {
+		if o.Interval <= 0 {
+			o.Interval = 10 * time.Minute
+		}
+		if o.DiscardRatio <= 0 || o.DiscardRatio >= 1 {
+			o.DiscardRatio = 0.5
+		}
+		db.gcOptions = &o
+		return nil
+	}
+}
+
+// gc collects garbage in the value log until it's stopped.
+type gc struct {
+	db   *DB
+	opts GCOptions
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (db *DB) startGC() {
+	if db.gcOptions == nil || db.readOnly || db.inMemory {
+		return
+	}
+	g := &gc{db: db, opts: *db.gcOptions, stop: make(chan struct{})}
+	g.wg.Add(1)
+	go g.run()
+	db.gc = g
+}
+
+// stopGC stops collecting garbage, waiting for a running collection.
+func (db *DB) stopGC() {
+	if db.gc == nil {
+		return
+	}
+	close(db.gc.stop)
+	db.gc.wg.Wait()
+	db.gc = nil
+}
+
+func (g *gc) run() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			if inQuietHours(g.db.now(), g.opts.QuietStart, g.opts.QuietEnd) {
+				g.collect()
+			}
+		}
+	}
+}
+
+// collect rewrites value log files until none is stale enough, or gc is
+// stopped.
+func (g *gc) collect() {
+	m := &g.db.metrics
+	start := time.Now()
+	rewrites := 0
+	var err error
+	for {
+		select {
+		case <-g.stop:
+			return
+		default:
+		}
+		err = g.db.db.RunValueLogGC(g.opts.DiscardRatio)
+		if err != nil {
+			break
+		}
+		rewrites++
+	}
+	m.gcRuns.Add(1)
+	m.gcRewrites.Add(uint64(rewrites))
+	logger := g.db.badgerOptions.Logger
+	if err != badger.ErrNoRewrite {
+		m.gcErrors.Add(1)
+		if logger != nil {
+			logger.Warningf("bow: value log GC failed after %d rewrites: %v", rewrites, err)
+		}
+		return
+	}
+	if logger != nil {
+		logger.Infof("bow: value log GC rewrote %d files in %v", rewrites, time.Since(start))
+	}
+}
+
+// inQuietHours reports whether the time of day of t is within start and
+// end, or true if they're equal.
+func inQuietHours(t time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	y, mo, d := t.Date()
+	day := t.Sub(time.Date(y, mo, d, 0, 0, 0, 0, t.Location()))
+	if start < end {
+		return day >= start && day < end
+	}
+	return day >= start || day < end
+}
@@ -0,0 +1,393 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Prefix reserved for geospatial indexes of fields tagged with `bow:"geo"`.
+//
+// A bucket's index is prefixed with geoPrefix followed by the bucket's
+// prefix, and holds:
+//
+//	'g' geohash key -> latitude and longitude
+//	'd' key         -> geohash
+var geoPrefix = []byte{reserved, 0x07}
+
+const (
+	// geohashPrecision is the length of indexed geohashes, which locate
+	// points within a few centimeters.
+	geohashPrecision = 12
+
+	// maxGeoCells is the maximum amount of geohash cells scanned by a query.
+	maxGeoCells = 32
+
+	// earthRadius is the mean radius of Earth in meters.
+	earthRadius = 6371008.8
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// ErrInvalidPoint is returned for latitudes outside of [-90, 90], longitudes
+// outside of [-180, 180], and radiuses that are negative, or for coordinates
+// that are NaN or infinite.
+var ErrInvalidPoint = errors.New("Invalid latitude or longitude")
+
+// Point is a location on Earth in degrees. Fields tagged with `bow:"geo"`
+// must be a Point, or a struct with float64 fields named Lat and Lng.
+type Point struct {
+	Lat, Lng float64
+}
+
+// Box is an area on Earth bounded by latitudes and longitudes, in degrees.
+// If MinLng is greater than MaxLng, the box crosses the antimeridian.
+type Box struct {
+	MinLat, MinLng float64
+	MaxLat, MaxLng float64
+}
+
+// Contains reports whether p is within the box.
+func (b Box) Contains(p Point) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	if b.MinLng <= b.MaxLng {
+		return p.Lng >= b.MinLng && p.Lng <= b.MaxLng
+	}
+	return p.Lng >= b.MinLng || p.Lng <= b.MaxLng
+}
+
+// GeoMatch is a record found by Near or Within.
+type GeoMatch struct {
+	// Key is the key of the record. Retrieve the record with Get(Key, &v).
+	Key []byte
+
+	// Point is the location of the record.
+	Point Point
+
+	// Distance is the distance in meters from the center of Near's query,
+	// or 0 for Within.
+	Distance float64
+}
+
+// Near finds the records whose field tagged with `bow:"geo"` is within
+// radius meters of the given point, ordered from nearest to farthest.
+func (b *Bucket) Near(lat, lng, radius float64) ([]GeoMatch, error) {
+	center := Point{lat, lng}
+	if err := center.validate(); err != nil {
+		return nil, err
+	}
+	if radius < 0 || math.IsNaN(radius) || math.IsInf(radius, 0) {
+		return nil, fmt.Errorf("bow: radius %v: %w", radius, ErrInvalidPoint)
+	}
+	// Bound the circle with a box, which crosses the antimeridian or covers
+	// all longitudes near the poles.
+	dLat := radius / earthRadius * 180 / math.Pi
+	box := Box{MinLat: lat - dLat, MaxLat: lat + dLat, MinLng: -180, MaxLng: 180}
+	if box.MinLat > -90 && box.MaxLat < 90 {
+		dLng := dLat / math.Cos(lat*math.Pi/180)
+		if dLng < 180 {
+			box.MinLng = normalizeLng(lng - dLng)
+			box.MaxLng = normalizeLng(lng + dLng)
+		}
+	}
+	var matches []GeoMatch
+	err := b.scanGeo(box, func(m GeoMatch) {
+		m.Distance = distance(center, m.Point)
+		if m.Distance <= radius {
+			matches = append(matches, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return bytes.Compare(matches[i].Key, matches[j].Key) < 0
+	})
+	return matches, nil
+}
+
+// Within finds the records whose field tagged with `bow:"geo"` is within
+// box, ordered by key.
+func (b *Bucket) Within(box Box) ([]GeoMatch, error) {
+	for _, p := range []Point{{box.MinLat, box.MinLng}, {box.MaxLat, box.MaxLng}} {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	var matches []GeoMatch
+	err := b.scanGeo(box, func(m GeoMatch) {
+		if box.Contains(m.Point) {
+			matches = append(matches, m)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return bytes.Compare(matches[i].Key, matches[j].Key) < 0
+	})
+	return matches, nil
+}
+
+// scanGeo calls fn for each indexed record in the geohash cells covering box.
+// Records may be outside of box, and must be filtered by fn.
+func (b *Bucket) scanGeo(box Box, fn func(m GeoMatch)) error {
+	if b.err != nil {
+		return b.err
+	}
+	box.MinLat = math.Max(box.MinLat, -90)
+	box.MaxLat = math.Min(box.MaxLat, 90)
+	if box.MinLat > box.MaxLat {
+		return nil
+	}
+	boxes := []Box{box}
+	if box.MinLng > box.MaxLng {
+		boxes = []Box{
+			{MinLat: box.MinLat, MaxLat: box.MaxLat, MinLng: box.MinLng, MaxLng: 180},
+			{MinLat: box.MinLat, MaxLat: box.MaxLat, MinLng: -180, MaxLng: box.MaxLng},
+		}
+	}
+	seen := make(map[string]bool)
+	return b.view(context.Background(), func(txn *badger.Txn) error {
+		for _, box := range boxes {
+			for _, cell := range geohashCover(box) {
+				prefix := b.geoCellKey(cell, nil)
+				it := txn.NewIterator(badger.DefaultIteratorOptions)
+				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+					item := it.Item()
+					key := item.Key()[len(prefix)+geohashPrecision-len(cell):]
+					if seen[string(key)] {
+						continue
+					}
+					seen[string(key)] = true
+					m := GeoMatch{Key: append([]byte(nil), key...)}
+					err := item.Value(func(value []byte) error {
+						m.Point = decodePoint(value)
+						return nil
+					})
+					if err != nil {
+						it.Close()
+						return err
+					}
+					fn(m)
+				}
+				it.Close()
+			}
+		}
+		return nil
+	})
+}
+
+// indexGeo updates the index of the record with the given key to the field
+// of sv tagged with `bow:"geo"`, within tx.
+func (b *Bucket) indexGeo(tx *Tx, fields *structFields, sv *structValue, key []byte) error {
+	err := b.unindexGeo(tx, key)
+	if err != nil {
+		return err
+	}
+	field := sv.value.Field(fields.geo)
+	p := Point{
+		Lat: field.FieldByName("Lat").Float(),
+		Lng: field.FieldByName("Lng").Float(),
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	hash := geohash(p, geohashPrecision)
+	err = tx.txn.Set(b.geoCellKey(hash, key), encodePoint(p))
+	if err != nil {
+		return err
+	}
+	return tx.txn.Set(b.geoDocKey(key), []byte(hash))
+}
+
+// unindexGeo removes the record with the given key from the index within tx.
+func (b *Bucket) unindexGeo(tx *Tx, key []byte) error {
+	entries, err := b.geoEntries(tx.txn, key)
+	if err != nil {
+		return err
+	}
+	return deleteKeys(tx.txn, entries)
+}
+
+// geoEntries returns the keys of the index entries of the record with the
+// given key within txn, including its doc.
+func (b *Bucket) geoEntries(txn *badger.Txn, key []byte) ([][]byte, error) {
+	docKey := b.geoDocKey(key)
+	item, err := txn.Get(docKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{docKey, b.geoCellKey(string(hash), key)}, nil
+}
+
+func (b *Bucket) geoCellKey(hash string, key []byte) []byte {
+	k := make([]byte, 0, len(geoPrefix)+len(b.prefix)+len(hash)+len(key)+1)
+	k = append(k, geoPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'g')
+	k = append(k, hash...)
+	return append(k, key...)
+}
+
+func (b *Bucket) geoDocKey(key []byte) []byte {
+	k := make([]byte, 0, len(geoPrefix)+len(b.prefix)+len(key)+1)
+	k = append(k, geoPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'd')
+	return append(k, key...)
+}
+
+// isGeoType reports whether typ can be tagged with `bow:"geo"`.
+func isGeoType(typ reflect.Type) bool {
+	if typ.Kind() != reflect.Struct {
+		return false
+	}
+	for _, name := range []string{"Lat", "Lng"} {
+		f, ok := typ.FieldByName(name)
+		if !ok || f.Type.Kind() != reflect.Float64 {
+			return false
+		}
+	}
+	return true
+}
+
+// geohashCover returns the geohashes of the cells covering box, of the
+// greatest precision at which there are at most maxGeoCells of them.
+func geohashCover(box Box) []string {
+	for precision := geohashPrecision; precision > 1; precision-- {
+		minLat, minLng := geohashCell(box.MinLat, box.MinLng, precision)
+		maxLat, maxLng := geohashCell(box.MaxLat, box.MaxLng, precision)
+		if (maxLat-minLat+1)*(maxLng-minLng+1) > maxGeoCells {
+			continue
+		}
+		var cells []string
+		for lat := minLat; lat <= maxLat; lat++ {
+			for lng := minLng; lng <= maxLng; lng++ {
+				cells = append(cells, geohashOfCell(lat, lng, precision))
+			}
+		}
+		return cells
+	}
+	// At precision 1, the whole world is only 32 cells.
+	cells := make([]string, len(geohashAlphabet))
+	for i := range cells {
+		cells[i] = geohashAlphabet[i : i+1]
+	}
+	return cells
+}
+
+// geohashCell returns the indexes of the cell containing the given point,
+// among the cells of the given precision.
+func geohashCell(lat, lng float64, precision int) (latIdx, lngIdx uint64) {
+	bits := uint(precision * 5)
+	latBits, lngBits := bits/2, bits-bits/2
+	latIdx = uint64((lat + 90) / 180 * float64(uint64(1)<<latBits))
+	lngIdx = uint64((lng + 180) / 360 * float64(uint64(1)<<lngBits))
+	// The maximum latitude and longitude belong to the last cell.
+	if max := uint64(1)<<latBits - 1; latIdx > max {
+		latIdx = max
+	}
+	if max := uint64(1)<<lngBits - 1; lngIdx > max {
+		lngIdx = max
+	}
+	return latIdx, lngIdx
+}
+
+// geohashOfCell returns the geohash of a cell by interleaving the bits of its
+// indexes, starting with longitude.
+func geohashOfCell(latIdx, lngIdx uint64, precision int) string {
+	bits := uint(precision * 5)
+	latBits, lngBits := bits/2, bits-bits/2
+	var hash uint64
+	for i := uint(0); i < bits; i++ {
+		var bit uint64
+		if i%2 == 0 {
+			lngBits--
+			bit = lngIdx >> lngBits & 1
+		} else {
+			latBits--
+			bit = latIdx >> latBits & 1
+		}
+		hash = hash<<1 | bit
+	}
+	buf := make([]byte, precision)
+	for i := precision - 1; i >= 0; i-- {
+		buf[i] = geohashAlphabet[hash&31]
+		hash >>= 5
+	}
+	return string(buf)
+}
+
+// geohash returns the geohash of p with the given precision.
+func geohash(p Point, precision int) string {
+	lat, lng := geohashCell(p.Lat, p.Lng, precision)
+	return geohashOfCell(lat, lng, precision)
+}
+
+// distance returns the great-circle distance between a and b in meters.
+func distance(a, b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// validate returns ErrInvalidPoint if p isn't a location on Earth.
+func (p Point) validate() error {
+	if math.IsNaN(p.Lat) || math.IsNaN(p.Lng) ||
+		p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		return fmt.Errorf("bow: point (%v, %v): %w", p.Lat, p.Lng, ErrInvalidPoint)
+	}
+	return nil
+}
+
+// normalizeLng wraps a finite longitude into [-180, 180].
+func normalizeLng(lng float64) float64 {
+	if lng >= -180 && lng <= 180 {
+		return lng
+	}
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return lng - 180
+}
+
+func encodePoint(p Point) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, math.Float64bits(p.Lat))
+	binary.BigEndian.PutUint64(b[8:], math.Float64bits(p.Lng))
+	return b
+}
+
+func decodePoint(b []byte) Point {
+	if len(b) != 16 {
+		return Point{}
+	}
+	return Point{
+		Lat: math.Float64frombits(binary.BigEndian.Uint64(b)),
+		Lng: math.Float64frombits(binary.BigEndian.Uint64(b[8:])),
+	}
+}
@@ -1,18 +1,24 @@
 module github.com/zippoxer/bow
 
-go 1.12
+go 1.23
+
+require (
+	github.com/dgraph-io/badger/v2 v2.0.2-rc1
+	github.com/sony/sonyflake v0.0.0-20181109022403-6d5bd6181009
+	github.com/tinylib/msgp v1.1.0
+)
 
 require (
 	github.com/DataDog/zstd v1.4.4 // indirect
+	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/deckarep/golang-set v1.7.1 // indirect
-	github.com/dgraph-io/badger/v2 v2.0.2-rc1
 	github.com/dgraph-io/ristretto v0.0.2 // indirect
 	github.com/dgryski/go-farm v0.0.0-20200201041132-a6ae2369ad13 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/golang/protobuf v1.3.4 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/philhofer/fwd v1.0.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sony/sonyflake v0.0.0-20181109022403-6d5bd6181009
-	github.com/tinylib/msgp v1.1.0
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
 	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae // indirect
 )
@@ -0,0 +1,242 @@
+package bow
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Prefix reserved for the times at which versions of records in buckets with
+// history were written.
+var historyPrefix = []byte{reserved, 0x04}
+
+// tombstone is the user meta of a version that marks a record in a bucket
+// with history as deleted. Badger discards the versions below a deletion when
+// compacting, so deleting the key would lose the record's history.
+const tombstone byte = 1 << 0
+
+// SetHistory keeps the given amount of versions of each record in the named
+// bucket, including the current one, for History and GetAt. Deleted records
+// keep their history too.
+//
+// Badger keeps the same amount of versions of every key, so it's raised to
+// the highest amount set for any bucket. Other buckets mark their writes to
+// discard earlier versions.
+func SetHistory(bucket string, versions int) Option {
+	return func(db *DB) error {
+		if versions < 1 {
+			return fmt.Errorf("bow.SetHistory: versions must be at least 1, got %d", versions)
+		}
+		if db.history == nil {
+			db.history = make(map[string]int)
+		}
+		db.history[bucket] = versions
+		return nil
+	}
+}
+
+// Revision is a version of a record, as returned by History.
+type Revision struct {
+	// Version is the version at which the revision was committed.
+	Version uint64
+
+	// Time is the time at which the revision was committed.
+	Time time.Time
+
+	// Deleted is true if the record was deleted by this revision.
+	Deleted bool
+
+	bucket *Bucket
+	key    []byte
+	value  []byte
+}
+
+// Decode decodes the revision into v, which must be a pointer to a struct.
+// It returns an error wrapping ErrNotFound if the revision is a deletion.
+func (r *Revision) Decode(v interface{}) error {
+	if r.Deleted {
+		return &KeyError{Bucket: r.bucket.name, Key: r.key, Op: "decode", Err: ErrNotFound}
+	}
+	typ, err := newStructType(v, true)
+	if err != nil {
+		return err
+	}
+	return r.bucket.decode(typ, r.key, r.value, v)
+}
+
+// History returns the kept versions of a record, from newest to oldest,
+// or an error wrapping ErrNotFound if there aren't any. The bucket must have
+// been configured with SetHistory.
+func (b *Bucket) History(key interface{}) ([]Revision, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	versions := b.db.history[b.name]
+	if versions == 0 {
+		return nil, ErrNoHistory
+	}
+	keyBytes, err := b.encodeKey("history", key)
+	if err != nil {
+		return nil, err
+	}
+	ik := b.internalKey(keyBytes)
+	var revs []Revision
+	err = b.view(context.Background(), func(txn *badger.Txn) error {
+		times, err := b.revisionTimes(txn, ik)
+		if err != nil {
+			return err
+		}
+		it := txn.NewKeyIterator(ik, badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && len(revs) < versions; it.Next() {
+			item := it.Item()
+			rev := Revision{
+				Version: item.Version(),
+				Time:    times[item.Version()],
+				Deleted: isDeleted(item),
+				bucket:  b,
+				key:     keyBytes,
+			}
+			if !rev.Deleted {
+				rev.value, err = item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+			}
+			revs = append(revs, rev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) == 0 {
+		return nil, &KeyError{Bucket: b.name, Key: keyBytes, Op: "history", Err: ErrNotFound}
+	}
+	return revs, nil
+}
+
+// GetAt retrieves a record as it was at the given version, such as the
+// Version of a Revision returned by History. It returns an error wrapping
+// ErrNotFound if the record didn't exist at that version, or if the version
+// isn't kept anymore.
+func (b *Bucket) GetAt(key interface{}, version uint64, v interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.db.history[b.name] == 0 {
+		return ErrNoHistory
+	}
+	typ, err := newStructType(v, true)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := b.encodeKey("get", key)
+	if err != nil {
+		return err
+	}
+	ik := b.internalKey(keyBytes)
+	notFound := &KeyError{Bucket: b.name, Key: keyBytes, Op: "get", Err: ErrNotFound}
+	return b.view(context.Background(), func(txn *badger.Txn) error {
+		it := txn.NewKeyIterator(ik, badger.DefaultIteratorOptions)
+		defer it.Close()
+		// Versions are iterated from newest to oldest.
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.Version() > version {
+				continue
+			}
+			if isDeleted(item) {
+				return notFound
+			}
+			return item.Value(func(value []byte) error {
+				return b.decode(typ, keyBytes, value, v)
+			})
+		}
+		return notFound
+	})
+}
+
+// revisionTimes returns the times at which the versions of ik were written,
+// by version.
+func (b *Bucket) revisionTimes(txn *badger.Txn, ik []byte) (map[uint64]time.Time, error) {
+	times := make(map[uint64]time.Time)
+	it := txn.NewKeyIterator(historyKey(ik), badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		err := item.Value(func(value []byte) error {
+			if len(value) == 8 {
+				nsec := int64(binary.BigEndian.Uint64(value))
+				times[item.Version()] = time.Unix(0, nsec)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return times, nil
+}
+
+// set sets ik to data within txn, keeping its history if the bucket is
+// configured to.
+func (b *Bucket) set(txn *badger.Txn, ik, data []byte) error {
+	if b.db.history[b.name] == 0 {
+		if b.db.badgerOptions.NumVersionsToKeep > 1 {
+			return txn.SetEntry(badger.NewEntry(ik, data).WithDiscard())
+		}
+		return txn.Set(ik, data)
+	}
+	err := txn.Set(ik, data)
+	if err != nil {
+		return err
+	}
+	return b.setRevisionTime(txn, ik)
+}
+
+// del deletes ik within txn, keeping its history if the bucket is configured
+// to, in which case a tombstone is written instead.
+func (b *Bucket) del(txn *badger.Txn, ik []byte) error {
+	if b.db.history[b.name] == 0 {
+		return txn.Delete(ik)
+	}
+	err := txn.SetEntry(badger.NewEntry(ik, nil).WithMeta(tombstone))
+	if err != nil {
+		return err
+	}
+	return b.setRevisionTime(txn, ik)
+}
+
+// isDeleted reports whether item is a deletion, or a tombstone.
+func isDeleted(item *badger.Item) bool {
+	return item.IsDeletedOrExpired() || item.UserMeta()&tombstone != 0
+}
+
+// getRecord is like txn.Get, but returns badger.ErrKeyNotFound for
+// tombstones.
+func getRecord(txn *badger.Txn, ik []byte) (*badger.Item, error) {
+	item, err := txn.Get(ik)
+	if err == nil && item.UserMeta()&tombstone != 0 {
+		return nil, badger.ErrKeyNotFound
+	}
+	return item, err
+}
+
+func (b *Bucket) setRevisionTime(txn *badger.Txn, ik []byte) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(b.db.now().UnixNano()))
+	return txn.Set(historyKey(ik), value)
+}
+
+// historyKey returns the key holding the times at which versions of ik were
+// written.
+func historyKey(ik []byte) []byte {
+	key := make([]byte, len(historyPrefix)+len(ik))
+	copy(key, historyPrefix)
+	copy(key[len(historyPrefix):], ik)
+	return key
+}
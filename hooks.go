@@ -0,0 +1,136 @@
+package bow
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// BeforePutter is implemented by record types that validate or set defaults
+// before they're persisted. An error aborts the Put.
+type BeforePutter interface {
+	BeforePut() error
+}
+
+// AfterGetter is implemented by record types that are notified after they're
+// retrieved, either by Get or during iteration. An error is returned by the
+// operation that retrieved the record.
+type AfterGetter interface {
+	AfterGet() error
+}
+
+// BeforeDeleter is implemented by record types that are notified before
+// they're deleted. The record is retrieved within the transaction of the
+// Delete, which is passed as tx, and an error aborts it.
+//
+// Since Delete only takes a key, BeforeDelete is only called for buckets
+// whose type is known, either from SetBucketType or from Typed.
+type BeforeDeleter interface {
+	BeforeDelete(tx *Tx) error
+}
+
+var (
+	typeOfBeforePutter  = reflect.TypeOf((*BeforePutter)(nil)).Elem()
+	typeOfAfterGetter   = reflect.TypeOf((*AfterGetter)(nil)).Elem()
+	typeOfBeforeDeleter = reflect.TypeOf((*BeforeDeleter)(nil)).Elem()
+)
+
+// SetBucketType sets the type of the records in the named bucket to the type
+// of v, a struct or a pointer to one. It lets Delete call BeforeDelete.
+func SetBucketType(bucket string, v interface{}) Option {
+	return func(db *DB) error {
+		typ, err := newStructType(v, false)
+		if err != nil {
+			return err
+		}
+		if _, err := typ.structFields(); err != nil {
+			return err
+		}
+		if db.bucketTypes == nil {
+			db.bucketTypes = make(map[string]*structType)
+		}
+		db.bucketTypes[bucket] = typ
+		return nil
+	}
+}
+
+// Tx is the transaction of the operation that called a hook. Changes made
+// with Tx are committed along with the operation, or not at all.
+type Tx struct {
+	db  *DB
+	txn *badger.Txn
+	ctx context.Context
+
+	// onCommit holds functions to call once the transaction is committed.
+	onCommit []func()
+}
+
+// afterCommit calls fn once the transaction is committed.
+func (tx *Tx) afterCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+func (tx *Tx) committed() {
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+}
+
+// Get retrieves a record from the named bucket by key, returning an error
+// wrapping ErrNotFound if it doesn't exist.
+func (tx *Tx) Get(bucket string, key interface{}, v interface{}) error {
+	b, ok := tx.db.bucket(bucket)
+	if !ok {
+		b = &Bucket{db: tx.db, name: bucket}
+	}
+	typ, err := newStructType(v, true)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := b.encodeKey("get", key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &KeyError{Bucket: bucket, Key: keyBytes, Op: "get", Err: ErrNotFound}
+	}
+	return b.getTxn(tx.ctx, tx.txn, typ, keyBytes, v)
+}
+
+// Put persists a record into the named bucket. If the bucket doesn't exist,
+// it's created like DB.Bucket does, regardless of whether the transaction is
+// committed.
+func (tx *Tx) Put(bucket string, v interface{}) error {
+	if tx.db.readOnly {
+		return ErrReadOnly
+	}
+	// The bucket isn't created within tx, since the metadata of buckets is
+	// kept in memory as well, and wouldn't be rolled back with tx.
+	b := tx.db.Bucket(bucket)
+	if b.err != nil {
+		return b.err
+	}
+	typ, err := newStructType(v, false)
+	if err != nil {
+		return err
+	}
+	return b.putTxn(tx, typ, v)
+}
+
+// Delete removes a record from the named bucket by key. If the bucket
+// doesn't exist, there's nothing to remove.
+func (tx *Tx) Delete(bucket string, key interface{}) error {
+	if tx.db.readOnly {
+		return ErrReadOnly
+	}
+	b, ok := tx.db.bucket(bucket)
+	if !ok {
+		b = &Bucket{db: tx.db, name: bucket}
+	}
+	keyBytes, err := b.encodeKey("delete", key)
+	if err != nil || !ok {
+		return err
+	}
+	return b.deleteTxn(tx, tx.db.bucketTypes[bucket], keyBytes)
+}
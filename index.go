@@ -0,0 +1,210 @@
+package bow
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Prefix reserved for secondary indexes of fields tagged with `bow:"index"`.
+//
+// A bucket's indexes are prefixed with indexPrefix followed by the bucket's
+// prefix, and hold:
+//
+//	'v' field 0x00 value key -> nothing
+//	'd' key                  -> names and values of the indexed fields
+//
+// Values are encoded by encodeIndexValue, so that they sort in the order of
+// the values they encode.
+var indexPrefix = []byte{reserved, 0x08}
+
+// isIndexType reports whether typ can be tagged with `bow:"index"`.
+func isIndexType(typ reflect.Type) bool {
+	if typ == typeOfTime || typ == typeOfBytes {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// encodeIndexValue encodes v, whose type satisfies isIndexType, so that
+// encoded values sort like the values they encode, and none of them is a
+// prefix of another.
+func encodeIndexValue(v reflect.Value) []byte {
+	if v.Type() == typeOfTime {
+		t := v.Interface().(time.Time)
+		b := binary.BigEndian.AppendUint64(nil, uint64(t.Unix())^1<<63)
+		return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return escapeIndexValue([]byte(v.String()))
+	case reflect.Slice:
+		return escapeIndexValue(v.Bytes())
+	case reflect.Bool:
+		if v.Bool() {
+			return []byte{1}
+		}
+		return []byte{0}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.BigEndian.AppendUint64(nil, uint64(v.Int())^1<<63)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.BigEndian.AppendUint64(nil, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		// Adding 0 turns -0 into 0, which are equal.
+		bits := math.Float64bits(v.Float() + 0)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return binary.BigEndian.AppendUint64(nil, bits)
+	}
+	return nil
+}
+
+// escapeIndexValue escapes each 0x00 in b as 0x00 0xff, and terminates it
+// with 0x00 0x01.
+func escapeIndexValue(b []byte) []byte {
+	e := make([]byte, 0, len(b)+2)
+	for _, c := range b {
+		e = append(e, c)
+		if c == 0 {
+			e = append(e, 0xff)
+		}
+	}
+	return append(e, 0, 1)
+}
+
+// indexValueLen returns the length of the value encoded by encodeIndexValue
+// at the start of b, given the type of the value.
+func indexValueLen(typ reflect.Type, b []byte) int {
+	if typ == typeOfTime {
+		return 12
+	}
+	switch typ.Kind() {
+	case reflect.String, reflect.Slice:
+		for i := 0; i+1 < len(b); i++ {
+			if b[i] == 0 {
+				if b[i+1] == 1 {
+					return i + 2
+				}
+				i++
+			}
+		}
+		return len(b)
+	case reflect.Bool:
+		return 1
+	}
+	return 8
+}
+
+// indexFields updates the indexes of the record with the given key, to the
+// fields of sv tagged with `bow:"index"`, within tx.
+func (b *Bucket) indexFields(tx *Tx, fields *structFields, sv *structValue, key []byte) error {
+	err := b.unindexFields(tx, key)
+	if err != nil {
+		return err
+	}
+	var doc []byte
+	for _, i := range fields.index {
+		name := sv.value.Type().Field(i).Name
+		value := encodeIndexValue(sv.value.Field(i))
+		err = tx.txn.Set(b.indexValueKey(name, value, key), nil)
+		if err != nil {
+			return err
+		}
+		doc = binary.AppendUvarint(doc, uint64(len(name)))
+		doc = append(doc, name...)
+		doc = binary.AppendUvarint(doc, uint64(len(value)))
+		doc = append(doc, value...)
+	}
+	return tx.txn.Set(b.indexDocKey(key), doc)
+}
+
+// unindexFields removes the record with the given key from the indexes
+// within tx.
+func (b *Bucket) unindexFields(tx *Tx, key []byte) error {
+	entries, err := b.fieldEntries(tx.txn, key)
+	if err != nil {
+		return err
+	}
+	return deleteKeys(tx.txn, entries)
+}
+
+// fieldEntries returns the keys of the index entries of the record with the
+// given key within txn, including its doc.
+func (b *Bucket) fieldEntries(txn *badger.Txn, key []byte) ([][]byte, error) {
+	docKey := b.indexDocKey(key)
+	item, err := txn.Get(docKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]byte{docKey}
+	for len(doc) > 0 {
+		var name, value []byte
+		name, doc = readIndexDoc(doc)
+		value, doc = readIndexDoc(doc)
+		if name == nil || value == nil {
+			break
+		}
+		entries = append(entries, b.indexValueKey(string(name), value, key))
+	}
+	return entries, nil
+}
+
+// deleteKeys deletes keys within txn.
+func deleteKeys(txn *badger.Txn, keys [][]byte) error {
+	for _, key := range keys {
+		err := txn.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readIndexDoc reads a length-prefixed string from doc, returning nil if doc
+// is malformed.
+func readIndexDoc(doc []byte) (s, rest []byte) {
+	n, i := binary.Uvarint(doc)
+	if i <= 0 || uint64(len(doc)-i) < n {
+		return nil, nil
+	}
+	return doc[i : i+int(n)], doc[i+int(n):]
+}
+
+func (b *Bucket) indexValueKey(name string, value, key []byte) []byte {
+	k := make([]byte, 0, len(indexPrefix)+len(b.prefix)+len(name)+len(value)+len(key)+2)
+	k = append(k, indexPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'v')
+	k = append(k, name...)
+	k = append(k, 0)
+	k = append(k, value...)
+	return append(k, key...)
+}
+
+func (b *Bucket) indexDocKey(key []byte) []byte {
+	k := make([]byte, 0, len(indexPrefix)+len(b.prefix)+len(key)+1)
+	k = append(k, indexPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'd')
+	return append(k, key...)
+}
@@ -0,0 +1,97 @@
+package bow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrSkip is returned by an Interceptor of an iteration to skip the record.
+var ErrSkip = errors.New("Record skipped by interceptor")
+
+// CallKind is the kind of operation of a Call.
+type CallKind int
+
+const (
+	CallPut CallKind = iota
+	CallGet
+	CallDelete
+	CallIterate
+)
+
+func (k CallKind) String() string {
+	switch k {
+	case CallPut:
+		return "put"
+	case CallGet:
+		return "get"
+	case CallDelete:
+		return "delete"
+	case CallIterate:
+		return "iterate"
+	}
+	return fmt.Sprintf("CallKind(%d)", int(k))
+}
+
+// Call is an operation on a single record, passed to an Interceptor.
+type Call struct {
+	// Context is the context of the operation, or context.Background() if
+	// the operation has none.
+	Context context.Context
+
+	Kind   CallKind
+	Bucket string
+
+	// Key is the encoded key of the record, and must not be modified.
+	Key []byte
+
+	// Value is the encoded value of the record. A put's value is set before
+	// next is called, and may be replaced to persist another value. The value
+	// of a get or an iteration is set by next, and may be replaced after next
+	// returns. It's nil for deletes and iterations of keys only.
+	Value []byte
+}
+
+// Interceptor is called around operations on records, such as to trace,
+// audit, authorize or fail them. Intercept must call next to proceed with the
+// operation, and may reject it by returning an error instead. Errors are
+// returned by the operation, and abort its transaction.
+//
+// Records deleted by cascading deletes, or updated by nullified references,
+// are intercepted as well, within the transaction of the original operation.
+type Interceptor interface {
+	Intercept(call *Call, next func(call *Call) error) error
+}
+
+// InterceptorFunc is an Interceptor that's a function.
+type InterceptorFunc func(call *Call, next func(call *Call) error) error
+
+func (f InterceptorFunc) Intercept(call *Call, next func(call *Call) error) error {
+	return f(call, next)
+}
+
+// SetInterceptors sets the interceptors of operations on records. The first
+// interceptor is the outermost, so it's called first and returns last.
+func SetInterceptors(interceptors ...Interceptor) Option {
+	return func(db *DB) error {
+		db.interceptors = interceptors
+		return nil
+	}
+}
+
+// intercept calls op with call through the interceptors.
+func (db *DB) intercept(call *Call, op func(call *Call) error) error {
+	if len(db.interceptors) == 0 {
+		return op(call)
+	}
+	var next func(i int, call *Call) error
+	next = func(i int, call *Call) error {
+		if i == len(db.interceptors) {
+			return op(call)
+		}
+		return db.interceptors[i].Intercept(call, func(call *Call) error {
+			return next(i+1, call)
+		})
+	}
+	return next(0, call)
+}
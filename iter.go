@@ -1,15 +1,18 @@
 package bow
 
 import (
+	"bytes"
+	"context"
 	"runtime"
 
 	"github.com/dgraph-io/badger/v2"
 )
 
 type Iter struct {
+	ctx        context.Context
 	bucket     *Bucket
 	prefix     []byte
-	txn        *badger.Txn
+	txn        *badger.Txn // nil if owned by a Snapshot
 	it         *badger.Iterator
 	resultType *structType
 	advanced   bool
@@ -17,63 +20,135 @@ type Iter struct {
 	err        error
 }
 
-func newIter(bucket *Bucket, prefix []byte) *Iter {
+func newIter(ctx context.Context, bucket *Bucket, prefix []byte) *Iter {
 	prefix = bucket.internalKey(prefix)
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchSize = runtime.GOMAXPROCS(-1)
-	txn := bucket.db.db.NewTransaction(false)
+	txn, discard := bucket.readTxn()
 	it := txn.NewIterator(opts)
 	it.Seek(prefix)
-	return &Iter{
+	iter := &Iter{
+		ctx:    ctx,
 		bucket: bucket,
-		txn:    txn,
 		it:     it,
 		prefix: prefix,
 	}
+	if discard {
+		iter.txn = txn
+	}
+	return iter
 }
 
 func (it *Iter) Next(result interface{}) bool {
-	if it.err != nil {
+	rec := it.record(false)
+	if rec == nil {
 		return false
 	}
-	if it.closed {
-		return false
+	if it.resultType == nil {
+		var err error
+		it.resultType, err = newStructType(result, true)
+		if err != nil {
+			it.err = err
+			return false
+		}
 	}
-	if it.advanced {
-		it.it.Next()
+	err := rec.decode(it.resultType, result)
+	if err != nil {
+		it.err = err
+		return false
 	}
-	if !it.it.ValidForPrefix(it.prefix) {
-		it.Close()
+	return true
+}
+
+// NextBytes is like Next, but copies the undecoded key and value of the next
+// record into key and value, reusing their capacity. Either may be nil.
+func (it *Iter) NextBytes(key, value *[]byte) bool {
+	rec := it.record(value == nil)
+	if rec == nil {
 		return false
 	}
-	item := it.it.Item()
-	ik := item.Key()
-	err := item.Value(func(v []byte) error {
-		var err error
-		if it.resultType == nil {
-			it.resultType, err = newStructType(result, true)
-			if err != nil {
-				return err
-			}
-		}
-		err = it.bucket.db.codec.Unmarshal(v, result)
+	if key != nil {
+		*key = append((*key)[:0], rec.Key()...)
+	}
+	if value != nil {
+		err := rec.valueFunc(func(v []byte) error {
+			*value = append((*value)[:0], v...)
+			return nil
+		})
 		if err != nil {
-			return err
+			it.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// record advances to the next record that isn't skipped by an Interceptor,
+// returning nil if there isn't one.
+func (it *Iter) record(keysOnly bool) *Record {
+	for it.advance() {
+		rec := &Record{bucket: it.bucket, item: it.it.Item()}
+		if len(it.bucket.db.interceptors) == 0 {
+			return rec
+		}
+		err := rec.intercept(it.ctx, keysOnly)
+		if err == ErrSkip {
+			continue
 		}
-		err = it.resultType.value(result).setKey(ik[bucketIdSize:])
 		if err != nil {
-			return err
+			it.err = err
+			return nil
 		}
-		return nil
-	})
+		return rec
+	}
+	return nil
+}
+
+// Seek moves the iterator to the first record whose key is greater than or
+// equal to key, so that it's returned by the following call to Next.
+func (it *Iter) Seek(key interface{}) {
+	if it.err != nil || it.closed {
+		return
+	}
+	keyBytes, err := it.bucket.encodeKey("seek", key)
 	if err != nil {
 		it.err = err
-		return false
+		return
+	}
+	ik := it.bucket.internalKey(keyBytes)
+	if bytes.Compare(ik, it.prefix) < 0 {
+		ik = it.prefix
 	}
+	it.it.Seek(ik)
+	it.advanced = false
+}
 
-	if !it.advanced {
-		it.advanced = true
+// advance moves to the next record, returning false if there isn't one.
+func (it *Iter) advance() bool {
+	if it.err != nil {
+		return false
 	}
+	if it.closed {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	if it.advanced {
+		it.it.Next()
+	}
+	// Tombstones of records in buckets with history are skipped.
+	for it.it.ValidForPrefix(it.prefix) && it.it.Item().UserMeta()&tombstone != 0 {
+		it.it.Next()
+	}
+	if !it.it.ValidForPrefix(it.prefix) {
+		it.Close()
+		return false
+	}
+	it.advanced = true
+	it.bucket.metrics().iterated.Add(1)
 	return true
 }
 
@@ -87,10 +162,12 @@ func (it *Iter) Err() error {
 // further results, Iter is closed automatically and it will suffice to check the
 // result of Err.
 func (it *Iter) Close() {
-	if it.err != nil {
+	if it.closed || it.it == nil {
 		return
 	}
 	it.closed = true
 	it.it.Close()
-	it.txn.Discard()
+	if it.txn != nil {
+		it.txn.Discard()
+	}
 }
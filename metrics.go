@@ -0,0 +1,279 @@
+package bow
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of latency histograms.
+var latencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// Metrics are statistics of a database's operations since it was opened.
+type Metrics struct {
+	// Buckets holds the metrics of each bucket that was operated on, by name.
+	// Buckets in namespaces are counted together with the buckets of the same
+	// name in other namespaces, under their path with the names of namespaces
+	// replaced by "*", such as "*/orders", so that the amount of metrics
+	// doesn't grow with the amount of namespaces.
+	Buckets map[string]BucketMetrics
+
+	// LSMSize and VlogSize are the sizes in bytes of Badger's LSM tree and
+	// value log, as of its last update, which Badger does once a minute.
+	LSMSize, VlogSize int64
+
+	// GCRuns, GCRewrites and GCErrors count the collections of garbage in
+	// the value log by SetValueLogGC, the value log files they rewrote, and
+	// the collections that failed.
+	GCRuns, GCRewrites, GCErrors uint64
+}
+
+// BucketMetrics are statistics of the operations on a bucket.
+type BucketMetrics struct {
+	// Gets, Puts and Deletes count the records retrieved, persisted and
+	// deleted, including by Tx, PutBytes and GetBytes. Puts and deletes are
+	// counted once their transaction is committed.
+	Gets, Puts, Deletes uint64
+
+	// Misses counts the records that weren't found.
+	Misses uint64
+
+	// Iterated counts the records iterated, including by queries and
+	// aggregations.
+	Iterated uint64
+
+	// Conflicts counts the transactions aborted because of a conflict with
+	// another transaction.
+	Conflicts uint64
+
+	// BytesEncoded and BytesDecoded count the bytes of records marshaled and
+	// unmarshaled by the codec.
+	BytesEncoded, BytesDecoded uint64
+
+	// Latencies of Get, Put and Delete.
+	GetLatency, PutLatency, DeleteLatency Histogram
+}
+
+// Histogram is a distribution of latencies.
+type Histogram struct {
+	// Bounds are the upper bounds of the histogram's buckets, and Counts[i]
+	// is the amount of observations less than or equal to Bounds[i].
+	Bounds []time.Duration
+	Counts []uint64
+
+	// Count and Sum are the amount and sum of all observations.
+	Count uint64
+	Sum   time.Duration
+}
+
+// metrics collects the metrics of a database.
+type metrics struct {
+	buckets sync.Map // Bucket name to *bucketMetrics.
+
+	gcRuns, gcRewrites, gcErrors atomic.Uint64
+}
+
+type bucketMetrics struct {
+	gets, puts, deletes, misses atomic.Uint64
+	iterated, conflicts         atomic.Uint64
+	bytesEncoded, bytesDecoded  atomic.Uint64
+	getLatency, putLatency      histogram
+	deleteLatency               histogram
+}
+
+type histogram struct {
+	counts [len(latencyBounds) + 1]atomic.Uint64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(start time.Time) {
+	d := time.Since(start)
+	i := sort.Search(len(latencyBounds), func(i int) bool {
+		return d <= latencyBounds[i]
+	})
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: latencyBounds[:],
+		Counts: make([]uint64, len(latencyBounds)),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		s.Count += h.counts[i].Load()
+		if i < len(s.Counts) {
+			s.Counts[i] = s.Count
+		}
+	}
+	return s
+}
+
+// bucket returns the metrics of the named bucket.
+func (m *metrics) bucket(name string) *bucketMetrics {
+	if bm, ok := m.buckets.Load(name); ok {
+		return bm.(*bucketMetrics)
+	}
+	bm, _ := m.buckets.LoadOrStore(name, new(bucketMetrics))
+	return bm.(*bucketMetrics)
+}
+
+func (b *Bucket) metrics() *bucketMetrics {
+	if len(b.prefix) > 0 && b.prefix[0] == namespaced {
+		return b.db.metrics.bucket(namespacedMetricsName(b.name))
+	}
+	return b.db.metrics.bucket(b.name)
+}
+
+// namespacedMetricsName returns the name under which the metrics of the
+// bucket at the given path in a namespace are counted.
+func namespacedMetricsName(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	return strings.Repeat("*/", strings.Count(path, "/")) + path[i+1:]
+}
+
+// Metrics returns the metrics of the database's operations.
+func (db *DB) Metrics() Metrics {
+	m := Metrics{Buckets: make(map[string]BucketMetrics)}
+	db.metrics.buckets.Range(func(name, v interface{}) bool {
+		bm := v.(*bucketMetrics)
+		m.Buckets[name.(string)] = BucketMetrics{
+			Gets:          bm.gets.Load(),
+			Puts:          bm.puts.Load(),
+			Deletes:       bm.deletes.Load(),
+			Misses:        bm.misses.Load(),
+			Iterated:      bm.iterated.Load(),
+			Conflicts:     bm.conflicts.Load(),
+			BytesEncoded:  bm.bytesEncoded.Load(),
+			BytesDecoded:  bm.bytesDecoded.Load(),
+			GetLatency:    bm.getLatency.snapshot(),
+			PutLatency:    bm.putLatency.snapshot(),
+			DeleteLatency: bm.deleteLatency.snapshot(),
+		}
+		return true
+	})
+	m.LSMSize, m.VlogSize = db.db.Size()
+	m.GCRuns = db.metrics.gcRuns.Load()
+	m.GCRewrites = db.metrics.gcRewrites.Load()
+	m.GCErrors = db.metrics.gcErrors.Load()
+	return m
+}
+
+// MetricsVar returns an expvar.Var of the database's Metrics, to be published
+// with expvar.Publish.
+func (db *DB) MetricsVar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return db.Metrics()
+	})
+}
+
+// MetricsHandler returns an http.Handler that serves the database's Metrics
+// in Prometheus' text format.
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writePrometheus(bw, db.Metrics())
+		bw.Flush()
+	})
+}
+
+func writePrometheus(w *bufio.Writer, m Metrics) {
+	names := make([]string, 0, len(m.Buckets))
+	for name := range m.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counters := []struct {
+		name, help string
+		value      func(bm BucketMetrics) uint64
+	}{
+		{"bow_gets_total", "Records retrieved.",
+			func(bm BucketMetrics) uint64 { return bm.Gets }},
+		{"bow_puts_total", "Records persisted.",
+			func(bm BucketMetrics) uint64 { return bm.Puts }},
+		{"bow_deletes_total", "Records deleted.",
+			func(bm BucketMetrics) uint64 { return bm.Deletes }},
+		{"bow_misses_total", "Records that weren't found.",
+			func(bm BucketMetrics) uint64 { return bm.Misses }},
+		{"bow_iterated_total", "Records iterated.",
+			func(bm BucketMetrics) uint64 { return bm.Iterated }},
+		{"bow_conflicts_total", "Transactions aborted by conflicts.",
+			func(bm BucketMetrics) uint64 { return bm.Conflicts }},
+		{"bow_encoded_bytes_total", "Bytes of records marshaled.",
+			func(bm BucketMetrics) uint64 { return bm.BytesEncoded }},
+		{"bow_decoded_bytes_total", "Bytes of records unmarshaled.",
+			func(bm BucketMetrics) uint64 { return bm.BytesDecoded }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{bucket=\"%s\"} %d\n", c.name, escapeLabel(name), c.value(m.Buckets[name]))
+		}
+	}
+
+	const duration = "bow_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of Get, Put and Delete.\n# TYPE %s histogram\n",
+		duration, duration)
+	for _, name := range names {
+		bm := m.Buckets[name]
+		for _, op := range []struct {
+			name string
+			h    Histogram
+		}{{"get", bm.GetLatency}, {"put", bm.PutLatency}, {"delete", bm.DeleteLatency}} {
+			labels := fmt.Sprintf("bucket=\"%s\",op=\"%s\"", escapeLabel(name), op.name)
+			for i, bound := range op.h.Bounds {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n",
+					duration, labels, bound.Seconds(), op.h.Counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", duration, labels, op.h.Count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", duration, labels, op.h.Sum.Seconds())
+			fmt.Fprintf(w, "%s_count{%s} %d\n", duration, labels, op.h.Count)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP bow_lsm_size_bytes Size of Badger's LSM tree.\n"+
+		"# TYPE bow_lsm_size_bytes gauge\nbow_lsm_size_bytes %d\n", m.LSMSize)
+	fmt.Fprintf(w, "# HELP bow_vlog_size_bytes Size of Badger's value log.\n"+
+		"# TYPE bow_vlog_size_bytes gauge\nbow_vlog_size_bytes %d\n", m.VlogSize)
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"bow_gc_runs_total", "Collections of garbage in the value log.", m.GCRuns},
+		{"bow_gc_rewrites_total", "Value log files rewritten by collections.", m.GCRewrites},
+		{"bow_gc_errors_total", "Collections that failed.", m.GCErrors},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			c.name, c.help, c.name, c.name, c.value)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,354 @@
+package bow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// First byte of the keys of records in namespaces.
+const namespaced byte = 0x01
+
+// bucketSpaces are the reserved prefixes under which buckets keep data other
+// than their records, prefixed with the bucket's prefix.
+var bucketSpaces = [][]byte{historyPrefix, textPrefix, geoPrefix, indexPrefix, refPrefix}
+
+// ErrNamespaceNotFound is returned by operations on a namespace that doesn't
+// exist, such as one that was dropped, or one that wasn't created in
+// read-only mode.
+var ErrNamespaceNotFound = errors.New("Namespace doesn't exist")
+
+// namespaceNotFound returns a NamespaceError wrapping ErrNamespaceNotFound.
+func namespaceNotFound(path string) error {
+	return &NamespaceError{Namespace: path, Op: "open", Err: ErrNamespaceNotFound}
+}
+
+// Namespace is a named group of buckets and nested namespaces, such as the
+// data of a single tenant.
+//
+// Unlike buckets created with DB.Bucket, buckets in namespaces don't count
+// towards MaxBuckets. Their records are prefixed with the namespace's id
+// followed by the bucket's id within the namespace, both varint-encoded.
+//
+// Buckets in namespaces are named by their path, such as "tenant-42/orders",
+// which is the name passed to KeyProvider. They aren't included in Backup.
+type Namespace struct {
+	db   *DB
+	id   uint64
+	path string
+	key  []byte
+	err  error
+}
+
+// namespaceMeta is the metadata of a namespace, stored under
+// namespaceMetaKey(parent, name).
+type namespaceMeta struct {
+	Id         uint64
+	Buckets    map[string]uint64
+	NextBucket uint64
+}
+
+// Namespace returns the named top-level namespace, creating it if it doesn't
+// exist. If an error has occurred during creation, it would be returned by
+// any operation on the returned namespace as a NamespaceError. In read-only
+// mode, the error of a namespace that doesn't exist wraps
+// ErrNamespaceNotFound.
+func (db *DB) Namespace(name string) *Namespace {
+	return db.namespace(nil, name)
+}
+
+// Namespaces returns a sorted list of the names of the top-level namespaces.
+func (db *DB) Namespaces() ([]string, error) {
+	return db.namespaceNames(0)
+}
+
+// Namespace returns the named namespace nested in ns, creating it if it
+// doesn't exist.
+func (ns *Namespace) Namespace(name string) *Namespace {
+	if ns.err != nil {
+		return &Namespace{db: ns.db, path: ns.path + "/" + name, err: ns.err}
+	}
+	return ns.db.namespace(ns, name)
+}
+
+// Namespaces returns a sorted list of the names of the namespaces nested
+// in ns.
+func (ns *Namespace) Namespaces() ([]string, error) {
+	if ns.err != nil {
+		return nil, ns.err
+	}
+	return ns.db.namespaceNames(ns.id)
+}
+
+// Path returns the names of ns and its ancestors, separated by slashes.
+func (ns *Namespace) Path() string {
+	return ns.path
+}
+
+// Bucket returns the named bucket in ns, creating it if it doesn't exist.
+// If an error has occurred during creation, it would be returned by
+// any operation on the returned bucket as a BucketError.
+func (ns *Namespace) Bucket(name string) *Bucket {
+	path := ns.path + "/" + name
+	if ns.err != nil {
+		return &Bucket{db: ns.db, name: path, err: &BucketError{Bucket: path, Op: "open", Err: ns.err}}
+	}
+	db := ns.db
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+	meta, err := db.namespaceMeta(ns.key)
+	if err != nil {
+		return &Bucket{db: db, name: path, err: &BucketError{Bucket: path, Op: "open", Err: err}}
+	}
+	if meta == nil {
+		return &Bucket{db: db, name: path, err: &BucketError{Bucket: path, Op: "open", Err: namespaceNotFound(ns.path)}}
+	}
+	id, ok := meta.Buckets[name]
+	if !ok {
+		if db.readOnly {
+			return &Bucket{db: db, name: path, err: &BucketError{Bucket: path, Op: "open", Err: ErrBucketNotFound}}
+		}
+		id = meta.NextBucket
+		meta.Buckets[name] = id
+		meta.NextBucket++
+		err = db.writeNamespaceMeta(ns.key, meta)
+		if err != nil {
+			delete(meta.Buckets, name)
+			meta.NextBucket--
+			return &Bucket{db: db, name: path, err: &BucketError{Bucket: path, Op: "create", Err: err}}
+		}
+	}
+	return &Bucket{
+		db:     db,
+		prefix: binary.AppendUvarint(namespacePrefix(ns.id), id),
+		name:   path,
+	}
+}
+
+// Buckets returns a sorted list of the names of the buckets in ns.
+func (ns *Namespace) Buckets() ([]string, error) {
+	if ns.err != nil {
+		return nil, ns.err
+	}
+	ns.db.metaMu.Lock()
+	defer ns.db.metaMu.Unlock()
+	meta, err := ns.db.namespaceMeta(ns.key)
+	if err != nil {
+		return nil, &NamespaceError{Namespace: ns.path, Op: "open", Err: err}
+	}
+	if meta == nil {
+		return nil, namespaceNotFound(ns.path)
+	}
+	names := make([]string, 0, len(meta.Buckets))
+	for name := range meta.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Drop deletes ns along with its buckets and nested namespaces. Buckets and
+// namespaces obtained from ns must not be used afterwards.
+func (ns *Namespace) Drop() error {
+	if ns.err != nil {
+		return ns.err
+	}
+	if ns.db.readOnly {
+		return ErrReadOnly
+	}
+	db := ns.db
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+
+	// Collect the ids of ns and its descendants.
+	ids := []uint64{ns.id}
+	for i := 0; i < len(ids); i++ {
+		err := db.forEachNamespace(ids[i], func(name string, meta *namespaceMeta) error {
+			ids = append(ids, meta.Id)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(ns.key)
+	})
+	if err != nil {
+		return err
+	}
+	delete(db.namespaces, string(ns.key))
+	for _, id := range ids {
+		err = db.db.DropPrefix(namespacePrefix(id))
+		if err != nil {
+			return err
+		}
+		for _, space := range bucketSpaces {
+			prefix := append(append([]byte(nil), space...), namespacePrefix(id)...)
+			err = db.db.DropPrefix(prefix)
+			if err != nil {
+				return err
+			}
+		}
+		metaPrefix := namespaceMetaKey(id, "")
+		err = db.db.DropPrefix(metaPrefix)
+		if err != nil {
+			return err
+		}
+		for key := range db.namespaces {
+			if bytes.HasPrefix([]byte(key), metaPrefix) {
+				delete(db.namespaces, key)
+			}
+		}
+	}
+	return nil
+}
+
+// namespace returns the named namespace nested in parent, or a top-level
+// namespace if parent is nil.
+func (db *DB) namespace(parent *Namespace, name string) *Namespace {
+	var parentId uint64
+	path := name
+	if parent != nil {
+		parentId = parent.id
+		path = parent.path + "/" + name
+	}
+	key := namespaceMetaKey(parentId, name)
+
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+	if parent != nil {
+		// Make sure parent wasn't dropped.
+		parentMeta, err := db.namespaceMeta(parent.key)
+		if err != nil {
+			return &Namespace{db: db, path: path, err: &NamespaceError{Namespace: parent.path, Op: "open", Err: err}}
+		}
+		if parentMeta == nil {
+			return &Namespace{db: db, path: path, err: namespaceNotFound(parent.path)}
+		}
+	}
+	meta, err := db.namespaceMeta(key)
+	if err != nil {
+		return &Namespace{db: db, path: path, err: &NamespaceError{Namespace: path, Op: "open", Err: err}}
+	}
+	if meta == nil {
+		if db.readOnly {
+			return &Namespace{db: db, path: path, err: namespaceNotFound(path)}
+		}
+		seq, err := db.sequence(&db.namespaceId, namespaceIdSequence)
+		if err != nil {
+			return &Namespace{db: db, path: path, err: &NamespaceError{Namespace: path, Op: "create", Err: err}}
+		}
+		nextId, err := seq.Next()
+		if err != nil {
+			return &Namespace{db: db, path: path, err: &NamespaceError{Namespace: path, Op: "create", Err: err}}
+		}
+		// Id 0 is the parent of top-level namespaces.
+		meta = &namespaceMeta{
+			Id:      nextId + 1,
+			Buckets: make(map[string]uint64),
+		}
+		err = db.writeNamespaceMeta(key, meta)
+		if err != nil {
+			return &Namespace{db: db, path: path, err: &NamespaceError{Namespace: path, Op: "create", Err: err}}
+		}
+	}
+	return &Namespace{db: db, id: meta.Id, path: path, key: key}
+}
+
+// namespaceMeta returns the metadata stored under key, or nil if it doesn't
+// exist. metaMu must be locked.
+func (db *DB) namespaceMeta(key []byte) (*namespaceMeta, error) {
+	if meta, ok := db.namespaces[string(key)]; ok {
+		return meta, nil
+	}
+	var meta *namespaceMeta
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			meta = new(namespaceMeta)
+			return json.Unmarshal(value, meta)
+		})
+	})
+	if err != nil || meta == nil {
+		return nil, err
+	}
+	db.namespaces[string(key)] = meta
+	return meta, nil
+}
+
+// writeNamespaceMeta stores meta under key. metaMu must be locked.
+func (db *DB) writeNamespaceMeta(key []byte, meta *namespaceMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, b)
+	})
+	if err != nil {
+		return err
+	}
+	db.namespaces[string(key)] = meta
+	return nil
+}
+
+func (db *DB) namespaceNames(parent uint64) ([]string, error) {
+	var names []string
+	err := db.forEachNamespace(parent, func(name string, meta *namespaceMeta) error {
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+// forEachNamespace calls fn for each namespace nested in parent, in the order
+// of their names.
+func (db *DB) forEachNamespace(parent uint64, fn func(name string, meta *namespaceMeta) error) error {
+	prefix := namespaceMetaKey(parent, "")
+	return db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var meta namespaceMeta
+			err := item.Value(func(value []byte) error {
+				return json.Unmarshal(value, &meta)
+			})
+			if err != nil {
+				return err
+			}
+			err = fn(string(item.Key()[len(prefix):]), &meta)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// namespaceMetaKey returns the key of the metadata of the named namespace
+// nested in parent. Since ids are varint-encoded, the keys of namespaces
+// nested in parent are prefixed with namespaceMetaKey(parent, "").
+func namespaceMetaKey(parent uint64, name string) []byte {
+	key := append([]byte(nil), namespaceMetaPrefix...)
+	key = binary.AppendUvarint(key, parent)
+	return append(key, name...)
+}
+
+// namespacePrefix returns the prefix of the keys of records in buckets in
+// the namespace.
+func namespacePrefix(id uint64) []byte {
+	return binary.AppendUvarint([]byte{namespaced}, id)
+}
@@ -0,0 +1,501 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Op is a comparison operator of a query predicate.
+type Op int
+
+const (
+	Eq  Op = iota // Equal to.
+	Ne            // Not equal to.
+	Gt            // Greater than.
+	Gte           // Greater than or equal to.
+	Lt            // Less than.
+	Lte           // Less than or equal to.
+)
+
+func (op Op) String() string {
+	switch op {
+	case Eq:
+		return "Eq"
+	case Ne:
+		return "Ne"
+	case Gt:
+		return "Gt"
+	case Gte:
+		return "Gte"
+	case Lt:
+		return "Lt"
+	case Lte:
+		return "Lte"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// match reports whether a comparison result c satisfies op.
+func (op Op) match(c int) bool {
+	switch op {
+	case Eq:
+		return c == 0
+	case Ne:
+		return c != 0
+	case Gt:
+		return c > 0
+	case Gte:
+		return c >= 0
+	case Lt:
+		return c < 0
+	case Lte:
+		return c <= 0
+	}
+	return false
+}
+
+// Query finds the records of a bucket that match predicates on their fields.
+// Build a query with Bucket.Query, and run it with Find.
+type Query struct {
+	bucket  *Bucket
+	preds   []predicate
+	orderBy string
+	reverse bool
+	limit   int
+	load    []string
+}
+
+type predicate struct {
+	field string
+	op    Op
+	value interface{}
+
+	// Resolved by Find.
+	index []int
+	typ   reflect.Type
+	rv    reflect.Value
+}
+
+// Query returns a query that matches all the records in the bucket.
+func (b *Bucket) Query() *Query {
+	return &Query{bucket: b}
+}
+
+// Where adds a predicate comparing the named field with value. The field
+// must be a string, []byte, bool, number or time.Time, and value must be
+// convertible to its type.
+//
+// If the field is the key, or is tagged with `bow:"index"`, Find scans only
+// the records that may match instead of the whole bucket.
+func (q *Query) Where(field string, op Op, value interface{}) *Query {
+	q.preds = append(q.preds, predicate{field: field, op: op, value: value})
+	return q
+}
+
+// And is the same as Where.
+func (q *Query) And(field string, op Op, value interface{}) *Query {
+	return q.Where(field, op, value)
+}
+
+// OrderBy orders the results by the named field, rather than by key.
+func (q *Query) OrderBy(field string) *Query {
+	q.orderBy = field
+	return q
+}
+
+// Reverse orders the results in descending order.
+func (q *Query) Reverse() *Query {
+	q.reverse = true
+	return q
+}
+
+// Limit limits the amount of results to n.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Load makes Find load the records referenced by the named fields of the
+// results, like DB.Load.
+func (q *Query) Load(fields ...string) *Query {
+	q.load = append(q.load, fields...)
+	return q
+}
+
+// Find runs the query, storing the results in slice, a pointer to a slice of
+// structs or of pointers to structs.
+//
+// Records put before a field was tagged with `bow:"index"`, or put with
+// PutBytes or Import without the bucket's type, aren't indexed, and Find
+// doesn't match them by predicates on indexed fields.
+func (q *Query) Find(slice interface{}) error {
+	return q.FindContext(context.Background(), slice)
+}
+
+// FindContext is like Find, but returns ctx.Err() if ctx is done before the
+// query is complete.
+func (q *Query) FindContext(ctx context.Context, slice interface{}) error {
+	b := q.bucket
+	if b.err != nil {
+		return b.err
+	}
+	sliceValue := reflect.ValueOf(slice)
+	if sliceValue.Kind() != reflect.Ptr || sliceValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("bow.Query: %T is not a pointer to a slice", slice)
+	}
+	sliceValue = sliceValue.Elem()
+	elemType := sliceValue.Type().Elem()
+	recordType := elemType
+	if recordType.Kind() == reflect.Ptr {
+		recordType = recordType.Elem()
+	}
+	if recordType.Kind() != reflect.Struct {
+		return fmt.Errorf("bow.Query: %T is not a pointer to a slice of structs", slice)
+	}
+	typ, err := newStructType(reflect.New(recordType).Interface(), true)
+	if err != nil {
+		return err
+	}
+	fields, err := typ.structFields()
+	if err != nil {
+		return err
+	}
+	preds := make([]predicate, len(q.preds))
+	for i, p := range q.preds {
+		preds[i], err = resolvePredicate(recordType, p)
+		if err != nil {
+			return err
+		}
+	}
+	var orderBy []int
+	if q.orderBy != "" {
+		f, ok := recordType.FieldByName(q.orderBy)
+		if !ok || !f.IsExported() || !isIndexType(f.Type) {
+			return fmt.Errorf("bow.Query: can't order by %s.%s", recordType, q.orderBy)
+		}
+		orderBy = f.Index
+	}
+
+	type result struct {
+		key   []byte
+		value reflect.Value
+	}
+	var results []result
+	// ordered is whether the scan yields records in the order of the results,
+	// so that it can stop at the limit.
+	ordered := false
+	collect := func(key, data []byte) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		v := reflect.New(recordType)
+		err := b.decode(typ, key, data, v.Interface())
+		if err != nil {
+			return false, err
+		}
+		for _, p := range preds {
+			if !p.op.match(compareValues(v.Elem().FieldByIndex(p.index), p.rv)) {
+				return true, nil
+			}
+		}
+		results = append(results, result{key: append([]byte(nil), key...), value: v})
+		return !ordered || q.reverse || q.limit <= 0 || len(results) < q.limit, nil
+	}
+
+	r, ok := q.keyRange(fields, preds)
+	p, useIndex := indexPredicate(fields, preds)
+	if useIndex && !ok {
+		ordered = len(orderBy) == 1 && orderBy[0] == p.index[0]
+		err = b.view(ctx, func(txn *badger.Txn) error {
+			return b.scanIndex(ctx, txn, p, collect)
+		})
+	} else {
+		ordered = orderBy == nil
+		var scanErr error
+		err = b.iterate(r, false, func(rec *Record) bool {
+			var more bool
+			scanErr = rec.valueFunc(func(data []byte) error {
+				var err error
+				more, err = collect(rec.Key(), data)
+				return err
+			})
+			return scanErr == nil && more
+		})
+		if err == nil {
+			err = scanErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ordered {
+		sort.SliceStable(results, func(i, j int) bool {
+			if orderBy != nil {
+				c := compareValues(
+					results[i].value.Elem().FieldByIndex(orderBy),
+					results[j].value.Elem().FieldByIndex(orderBy))
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return bytes.Compare(results[i].key, results[j].key) < 0
+		})
+	}
+	if q.reverse {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[:q.limit]
+	}
+
+	out := reflect.MakeSlice(sliceValue.Type(), len(results), len(results))
+	for i, r := range results {
+		if elemType.Kind() == reflect.Ptr {
+			out.Index(i).Set(r.value)
+		} else {
+			out.Index(i).Set(r.value.Elem())
+		}
+	}
+	sliceValue.Set(out)
+	if len(q.load) > 0 {
+		return b.view(ctx, func(txn *badger.Txn) error {
+			return b.db.loadTxn(ctx, txn, slice, q.load)
+		})
+	}
+	return nil
+}
+
+// keyRange returns the range of keys that the predicates on the key field
+// limit the query to, if there are any. Only string and []byte keys sort
+// like their encoding.
+func (q *Query) keyRange(fields *structFields, preds []predicate) (keyRange, bool) {
+	var r keyRange
+	found := false
+	for _, p := range preds {
+		if fields.key == -1 || len(p.index) != 1 || p.index[0] != fields.key ||
+			p.op == Ne {
+			continue
+		}
+		kind := p.typ.Kind()
+		if kind != reflect.String && p.typ != typeOfBytes {
+			continue
+		}
+		key, err := keyCodec.Marshal(p.rv.Interface(), nil)
+		if err != nil {
+			continue
+		}
+		found = true
+		// The smallest key greater than key.
+		next := append(append([]byte(nil), key...), 0)
+		var start, end []byte
+		switch p.op {
+		case Eq:
+			start, end = key, next
+		case Gt:
+			start = next
+		case Gte:
+			start = key
+		case Lt:
+			end = key
+		case Lte:
+			end = next
+		}
+		if start != nil && bytes.Compare(start, r.start) > 0 {
+			r.start = start
+		}
+		if end != nil && (r.end == nil || bytes.Compare(end, r.end) < 0) {
+			r.end = end
+		}
+	}
+	if r.end != nil && bytes.Compare(r.start, r.end) > 0 {
+		r.start = r.end
+	}
+	return r, found
+}
+
+// indexPredicate returns a predicate on a field tagged with `bow:"index"`, if
+// there is one, preferring Eq.
+func indexPredicate(fields *structFields, preds []predicate) (predicate, bool) {
+	var found *predicate
+	for i, p := range preds {
+		if len(p.index) != 1 || p.op == Ne {
+			continue
+		}
+		for _, fi := range fields.index {
+			if fi == p.index[0] && (found == nil || p.op == Eq && found.op != Eq) {
+				found = &preds[i]
+			}
+		}
+	}
+	if found == nil {
+		return predicate{}, false
+	}
+	return *found, true
+}
+
+// scanIndex calls fn with the key and value of each record whose entry in the
+// index of p's field may satisfy p, in the order of the index, until fn
+// returns false. Records are passed through the interceptors of an iteration.
+func (b *Bucket) scanIndex(ctx context.Context, txn *badger.Txn, p predicate, fn func(key, data []byte) (bool, error)) error {
+	prefix := b.indexValueKey(p.field, nil, nil)
+	value := encodeIndexValue(p.rv)
+	seek := prefix
+	switch p.op {
+	case Eq, Gt, Gte:
+		seek = b.indexValueKey(p.field, value, nil)
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		rest := it.Item().Key()[len(prefix):]
+		n := indexValueLen(p.typ, rest)
+		c := bytes.Compare(rest[:n], value)
+		if (p.op == Eq || p.op == Lt || p.op == Lte) && !p.op.match(c) {
+			break
+		}
+		if !p.op.match(c) {
+			continue
+		}
+		key := rest[n:]
+		item, err := getRecord(txn, b.internalKey(key))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.metrics().iterated.Add(1)
+		rec := &Record{bucket: b, item: item}
+		if len(b.db.interceptors) > 0 {
+			err := rec.intercept(ctx, false)
+			if err == ErrSkip {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		var more bool
+		err = rec.valueFunc(func(data []byte) error {
+			more, err = fn(key, data)
+			return err
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvePredicate finds p's field in typ, and converts p's value to the
+// field's type.
+func resolvePredicate(typ reflect.Type, p predicate) (predicate, error) {
+	f, ok := typ.FieldByName(p.field)
+	if !ok {
+		return p, fmt.Errorf("bow.Query: type %s has no field %s", typ, p.field)
+	}
+	if !f.IsExported() {
+		return p, fmt.Errorf("bow.Query: field %s.%s isn't exported", typ, p.field)
+	}
+	if !isIndexType(f.Type) {
+		return p, fmt.Errorf("bow.Query: field %s.%s of type %s can't be compared",
+			typ, p.field, f.Type)
+	}
+	if p.op < Eq || p.op > Lte {
+		return p, fmt.Errorf("bow.Query: invalid operator %s", p.op)
+	}
+	rv, ok := convertValue(p.value, f.Type)
+	if !ok {
+		return p, fmt.Errorf("bow.Query: can't compare %s.%s of type %s with %T",
+			typ, p.field, f.Type, p.value)
+	}
+	p.index, p.typ, p.rv = f.Index, f.Type, rv
+	return p, nil
+}
+
+// convertValue converts v to typ, if it can be converted without loss.
+func convertValue(v interface{}, typ reflect.Type) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return rv, false
+	}
+	if rv.Type() == typ {
+		return rv, true
+	}
+	if typ == typeOfTime || !rv.Type().ConvertibleTo(typ) {
+		return rv, false
+	}
+	if isNumeric(rv.Kind()) && isNumeric(typ.Kind()) {
+		converted := rv.Convert(typ)
+		if converted.Convert(rv.Type()).Interface() != rv.Interface() {
+			return rv, false
+		}
+		return converted, true
+	}
+	if rv.Kind() != typ.Kind() {
+		return rv, false
+	}
+	return rv.Convert(typ), true
+}
+
+// compareValues compares two values of the same type, which satisfies
+// isIndexType.
+func compareValues(a, b reflect.Value) int {
+	if a.Type() == typeOfTime {
+		return a.Interface().(time.Time).Compare(b.Interface().(time.Time))
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Slice:
+		return bytes.Compare(a.Bytes(), b.Bytes())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case b.Bool():
+			return -1
+		}
+		return 1
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, y := a.Int(), b.Int()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, y := a.Uint(), b.Uint()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case reflect.Float32, reflect.Float64:
+		x, y := a.Float(), b.Float()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,330 @@
+package bow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/zippoxer/bow/codec"
+)
+
+// ErrMissingRef is returned by Put when referential integrity is enabled with
+// SetRefIntegrity, and a field tagged with `bow:"ref=bucket"` references a
+// record that doesn't exist.
+var ErrMissingRef = errors.New("Referenced record doesn't exist")
+
+var typeOfMarshaler = reflect.TypeOf((*codec.Marshaler)(nil)).Elem()
+
+// refField is a field tagged with `bow:"ref=bucket"`.
+type refField struct {
+	index    int
+	bucket   string
+	onDelete refAction
+}
+
+// SetRefIntegrity sets whether Put rejects records whose fields tagged with
+// `bow:"ref=bucket"` reference records that don't exist, with ErrMissingRef.
+// Zero references aren't checked.
+func SetRefIntegrity(enabled bool) Option {
+	return func(db *DB) error {
+		db.refIntegrity = enabled
+		return nil
+	}
+}
+
+// Load retrieves the records referenced by the named fields of v, a pointer
+// to a struct or to a slice of structs, in a single transaction.
+//
+// The references of a field named Author are held by a field named AuthorId
+// (or AuthorID) tagged with `bow:"ref=bucket"`, where bucket is the name of a
+// top-level bucket. Author is set to the referenced record, and must be a
+// struct or a pointer to one. The references of a field named Tags are held
+// by a slice named TagIds (or TagIDs), and Tags is set to a slice of the
+// referenced records that exist.
+//
+// Fields that Load sets are persisted by Put like any other field, unless
+// they're left out by the codec, such as with the tag `json:"-"`.
+func (db *DB) Load(v interface{}, fields ...string) error {
+	return db.LoadContext(context.Background(), v, fields...)
+}
+
+// LoadContext is like Load, but returns ctx.Err() if ctx is done.
+func (db *DB) LoadContext(ctx context.Context, v interface{}, fields ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.db.View(func(txn *badger.Txn) error {
+		return db.loadTxn(ctx, txn, v, fields)
+	})
+}
+
+// loadTxn is like Load, but within txn.
+func (db *DB) loadTxn(ctx context.Context, txn *badger.Txn, v interface{}, names []string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bow.Load: %T is not a pointer", v)
+	}
+	rv = rv.Elem()
+	recordType := rv.Type()
+	var records []reflect.Value
+	switch rv.Kind() {
+	case reflect.Struct:
+		records = append(records, rv)
+	case reflect.Slice:
+		recordType = recordType.Elem()
+		if recordType.Kind() == reflect.Ptr {
+			recordType = recordType.Elem()
+		}
+		for i := 0; i < rv.Len(); i++ {
+			record := rv.Index(i)
+			if record.Kind() == reflect.Ptr {
+				if record.IsNil() {
+					continue
+				}
+				record = record.Elem()
+			}
+			records = append(records, record)
+		}
+	}
+	if recordType.Kind() != reflect.Struct {
+		return fmt.Errorf("bow.Load: %T is not a pointer to a struct or a slice of structs", v)
+	}
+	typ, err := newStructType(reflect.New(recordType).Interface(), true)
+	if err != nil {
+		return err
+	}
+	fields, err := typ.structFields()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = db.loadField(ctx, txn, recordType, fields, records, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadField sets the named field of each record to the records it references.
+func (db *DB) loadField(ctx context.Context, txn *badger.Txn, recordType reflect.Type, fields *structFields, records []reflect.Value, name string) error {
+	target, ok := recordType.FieldByName(name)
+	if !ok || len(target.Index) != 1 {
+		return fmt.Errorf("bow.Load: type %s has no field %s", recordType, name)
+	}
+	var ref refField
+	found := false
+	for _, r := range fields.refs {
+		refName := recordType.Field(r.index).Name
+		for _, suffix := range []string{"Id", "ID", "Ids", "IDs"} {
+			base, ok := strings.CutSuffix(refName, suffix)
+			if ok && (base == name || suffix[len(suffix)-1] == 's' && base+"s" == name) {
+				ref, found = r, true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("bow.Load: type %s has no field %sId tagged ref", recordType, name)
+	}
+	many := isRefSlice(recordType.Field(ref.index).Type)
+	elemType := target.Type
+	if many {
+		if elemType.Kind() != reflect.Slice {
+			return fmt.Errorf("bow.Load: field %s.%s isn't a slice", recordType, name)
+		}
+		elemType = elemType.Elem()
+	}
+	refType := elemType
+	if refType.Kind() == reflect.Ptr {
+		refType = refType.Elem()
+	}
+	if refType.Kind() != reflect.Struct {
+		return fmt.Errorf("bow.Load: field %s.%s isn't a struct or a pointer to one",
+			recordType, name)
+	}
+	typ, err := newStructType(reflect.New(refType).Interface(), true)
+	if err != nil {
+		return err
+	}
+	bucket, bucketExists := db.bucket(ref.bucket)
+
+	// loaded holds the referenced records by key, or the zero Value for
+	// records that don't exist.
+	loaded := make(map[string]reflect.Value)
+	get := func(key []byte) (reflect.Value, error) {
+		if v, ok := loaded[string(key)]; ok {
+			return v, nil
+		}
+		var v reflect.Value
+		if bucketExists {
+			p := reflect.New(refType)
+			err := bucket.getTxn(ctx, txn, typ, key, p.Interface())
+			switch {
+			case err == nil:
+				v = p.Elem()
+			case errors.Is(err, ErrNotFound):
+			default:
+				return v, err
+			}
+		}
+		loaded[string(key)] = v
+		return v, nil
+	}
+	// elem converts a referenced record to elemType, copying it so that
+	// records don't share it.
+	elem := func(v reflect.Value) reflect.Value {
+		if elemType.Kind() == reflect.Ptr {
+			p := reflect.New(refType)
+			p.Elem().Set(v)
+			return p
+		}
+		return v
+	}
+
+	for _, record := range records {
+		keys, err := refKeys(record.Field(ref.index))
+		if err != nil {
+			return err
+		}
+		field := record.Field(target.Index[0])
+		if many {
+			values := reflect.MakeSlice(target.Type, 0, len(keys))
+			for _, key := range keys {
+				v, err := get(key)
+				if err != nil {
+					return err
+				}
+				if v.IsValid() {
+					values = reflect.Append(values, elem(v))
+				}
+			}
+			field.Set(values)
+			continue
+		}
+		field.Set(reflect.Zero(target.Type))
+		if len(keys) == 0 {
+			continue
+		}
+		v, err := get(keys[0])
+		if err != nil {
+			return err
+		}
+		if v.IsValid() {
+			field.Set(elem(v))
+		}
+	}
+	return nil
+}
+
+// checkRefs returns ErrMissingRef if a field of sv tagged with
+// `bow:"ref=bucket"` references a record that doesn't exist within tx.
+func (b *Bucket) checkRefs(tx *Tx, fields *structFields, sv *structValue) error {
+	for _, ref := range fields.refs {
+		keys, err := refKeys(sv.value.Field(ref.index))
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		bucket, ok := b.db.bucket(ref.bucket)
+		for _, key := range keys {
+			if ok {
+				_, err = getRecord(tx.txn, bucket.internalKey(key))
+				if err == nil {
+					continue
+				}
+				if err != badger.ErrKeyNotFound {
+					return err
+				}
+			}
+			return fmt.Errorf("bow: %s.%s references key %q in bucket %s: %w",
+				sv.value.Type(), sv.value.Type().Field(ref.index).Name, key,
+				ref.bucket, ErrMissingRef)
+		}
+	}
+	return nil
+}
+
+// refKeys returns the non-zero keys that a field tagged with
+// `bow:"ref=bucket"` holds.
+func refKeys(field reflect.Value) ([][]byte, error) {
+	if !isRefSlice(field.Type()) {
+		if field.IsZero() {
+			return nil, nil
+		}
+		key, err := marshalRef(field)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{key}, nil
+	}
+	keys := make([][]byte, 0, field.Len())
+	for i := 0; i < field.Len(); i++ {
+		if field.Index(i).IsZero() {
+			continue
+		}
+		key, err := marshalRef(field.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// refKinds maps the kinds of integer references to their unnamed types,
+// which the key codec encodes.
+var refKinds = map[reflect.Kind]reflect.Type{
+	reflect.Int:    reflect.TypeOf(int(0)),
+	reflect.Int8:   reflect.TypeOf(int8(0)),
+	reflect.Int16:  reflect.TypeOf(int16(0)),
+	reflect.Int32:  reflect.TypeOf(int32(0)),
+	reflect.Int64:  reflect.TypeOf(int64(0)),
+	reflect.Uint:   reflect.TypeOf(uint(0)),
+	reflect.Uint8:  reflect.TypeOf(uint8(0)),
+	reflect.Uint16: reflect.TypeOf(uint16(0)),
+	reflect.Uint32: reflect.TypeOf(uint32(0)),
+	reflect.Uint64: reflect.TypeOf(uint64(0)),
+}
+
+func marshalRef(v reflect.Value) ([]byte, error) {
+	if v.Type().Implements(typeOfMarshaler) {
+		return keyCodec.Marshal(v.Interface(), nil)
+	}
+	if v.Kind() == reflect.String {
+		return []byte(v.String()), nil
+	}
+	// Named integer types, such as `type UserId int64`, are encoded like
+	// their underlying type.
+	if typ, ok := refKinds[v.Kind()]; ok {
+		v = v.Convert(typ)
+	}
+	return keyCodec.Marshal(v.Interface(), nil)
+}
+
+// isRefType reports whether typ can be tagged with `bow:"ref=bucket"`, which
+// is true for keys and slices of keys.
+func isRefType(typ reflect.Type) bool {
+	if isRefSlice(typ) {
+		typ = typ.Elem()
+	}
+	if typ == typeOfBytes || typ.Implements(typeOfMarshaler) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// isRefSlice reports whether typ holds several references.
+func isRefSlice(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8
+}
@@ -0,0 +1,471 @@
+package bow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// Key reserved for the version of the leader a follower has applied.
+var replicationKey = []byte{reserved, 0x05}
+
+// replicationPollInterval is how often a leader checks for changes it
+// wasn't notified of, such as those committed before it subscribed to them.
+const replicationPollInterval = time.Second
+
+// replicationMaxPending is the amount of changed keys a leader holds for a
+// follower, beyond which it scans for the changes instead.
+const replicationMaxPending = 100000
+
+// A KVList of a frame is written once it holds replicationListSize keys or
+// replicationListBytes bytes.
+const (
+	replicationListSize  = 1000
+	replicationListBytes = 4 << 20
+)
+
+// badgerPrefix is the prefix of Badger's internal keys.
+var badgerPrefix = []byte("!badger!")
+
+// replicationPrefixes are the prefixes a leader subscribes to, which are all
+// the single bytes, since Badger doesn't match the empty prefix.
+var replicationPrefixes = func() [][]byte {
+	prefixes := make([][]byte, 256)
+	for i := range prefixes {
+		prefixes[i] = []byte{byte(i)}
+	}
+	return prefixes
+}()
+
+// ServeReplication streams committed changes to a follower over rw, until
+// ctx is done or rw fails. The follower, which calls Follow on the other end,
+// first sends the version it has applied, so that it resumes where it
+// stopped.
+//
+// The follower first catches up with the keys changed after that version,
+// including Bow's metadata, and then receives the keys changed by each
+// commit, so it ends up as an exact copy of the leader. Like incremental
+// backups, deletions that Badger has already compacted away, and namespaces
+// dropped with Namespace.Drop, aren't replicated.
+func (db *DB) ServeReplication(ctx context.Context, rw io.ReadWriter) error {
+	var applied uint64
+	err := binary.Read(rw, binary.LittleEndian, &applied)
+	if err != nil {
+		return err
+	}
+
+	// Collect changes, and poll in case some were committed before the
+	// subscription started.
+	changes := &replicationChanges{changed: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go db.db.Subscribe(ctx, changes.add, replicationPrefixes...)
+	ticker := time.NewTicker(replicationPollInterval)
+	defer ticker.Stop()
+
+	w := bufio.NewWriter(rw)
+	applied, err = db.writeReplicationScan(w, applied)
+	if err != nil {
+		return err
+	}
+	// committed is the newest version committed as of the previous tick, by
+	// which its notification must have arrived.
+	var committed uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changes.changed:
+		case <-ticker.C:
+			if committed > applied {
+				changes.miss()
+			}
+			txn := db.db.NewTransaction(false)
+			committed = txn.ReadTs()
+			txn.Discard()
+		}
+		keys, version, missed := changes.take()
+		switch {
+		case missed:
+			applied, err = db.writeReplicationScan(w, applied)
+		case len(keys) > 0:
+			applied, err = db.writeReplicationKeys(w, applied, keys, version)
+		case version > applied:
+			// Only keys that aren't replicated changed.
+			applied = version
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replicationChanges collects the keys changed by commits, as notified by
+// Badger, until they're sent to a follower.
+type replicationChanges struct {
+	mu      sync.Mutex
+	keys    map[string]struct{}
+	version uint64 // The newest version of the keys.
+	missed  bool   // Whether changes weren't collected.
+	changed chan struct{}
+}
+
+// add collects the keys of list. Badger's notifications don't tell
+// deletions apart from empty values, so only the keys are collected.
+func (c *replicationChanges) add(list *badger.KVList) error {
+	c.mu.Lock()
+	for _, kv := range list.Kv {
+		if kv.Version > c.version {
+			c.version = kv.Version
+		}
+		if bytes.HasPrefix(kv.Key, badgerPrefix) || bytes.Equal(kv.Key, replicationKey) {
+			continue
+		}
+		if c.missed {
+			continue
+		}
+		if len(c.keys) >= replicationMaxPending {
+			c.keys, c.missed = nil, true
+			continue
+		}
+		if c.keys == nil {
+			c.keys = make(map[string]struct{})
+		}
+		c.keys[string(kv.Key)] = struct{}{}
+	}
+	c.mu.Unlock()
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// miss marks changes as missed.
+func (c *replicationChanges) miss() {
+	c.mu.Lock()
+	c.keys, c.missed = nil, true
+	c.mu.Unlock()
+}
+
+// take returns and resets the collected keys, along with the newest version
+// of them, and whether changes were missed.
+func (c *replicationChanges) take() (keys map[string]struct{}, version uint64, missed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys, version, missed = c.keys, c.version, c.missed
+	c.keys, c.missed = nil, false
+	return keys, version, missed
+}
+
+// writeReplicationScan writes a frame of the keys changed after version
+// applied, found by scanning all keys, and returns the version scanned.
+func (db *DB) writeReplicationScan(w *bufio.Writer, applied uint64) (uint64, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	fw := &frameWriter{w: w}
+	var lastKey []byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		// Versions of a key are iterated from newest to oldest, and only
+		// the newest matters.
+		if bytes.Equal(item.Key(), lastKey) {
+			continue
+		}
+		lastKey = item.KeyCopy(nil)
+		if item.Version() <= applied || bytes.Equal(lastKey, replicationKey) {
+			continue
+		}
+		kv := &pb.KV{Key: lastKey, Version: item.Version()}
+		if item.IsDeletedOrExpired() {
+			kv.Meta = []byte{badgerBitDelete}
+		} else {
+			err := replicationValue(kv, item)
+			if err != nil {
+				return 0, err
+			}
+		}
+		err := fw.add(kv)
+		if err != nil {
+			return 0, err
+		}
+	}
+	version := txn.ReadTs()
+	if version < applied {
+		version = applied
+	}
+	return version, fw.end(version)
+}
+
+// writeReplicationKeys writes a frame of the given keys, changed by commits
+// up to version, and returns version.
+func (db *DB) writeReplicationKeys(w *bufio.Writer, applied uint64, keys map[string]struct{}, version uint64) (uint64, error) {
+	// The transaction sees the commits, since they were notified.
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	fw := &frameWriter{w: w}
+	for key := range keys {
+		kv := &pb.KV{Key: []byte(key)}
+		item, err := txn.Get(kv.Key)
+		switch {
+		case err == badger.ErrKeyNotFound:
+			kv.Meta = []byte{badgerBitDelete}
+		case err != nil:
+			return 0, err
+		default:
+			err = replicationValue(kv, item)
+			if err != nil {
+				return 0, err
+			}
+		}
+		err = fw.add(kv)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if version < applied {
+		version = applied
+	}
+	return version, fw.end(version)
+}
+
+// replicationValue sets the value and user meta of kv to those of item.
+func replicationValue(kv *pb.KV, item *badger.Item) error {
+	var err error
+	kv.Value, err = item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if meta := item.UserMeta(); meta != 0 {
+		kv.UserMeta = []byte{meta}
+	}
+	return nil
+}
+
+// frameWriter writes a frame of changes for a follower. A frame holds
+// length-prefixed KVLists, followed by a zero length and the version of its
+// newest change.
+type frameWriter struct {
+	w       *bufio.Writer
+	list    pb.KVList
+	size    int
+	written bool
+}
+
+// add adds kv to the frame.
+func (fw *frameWriter) add(kv *pb.KV) error {
+	fw.list.Kv = append(fw.list.Kv, kv)
+	fw.size += kv.Size()
+	if len(fw.list.Kv) < replicationListSize && fw.size < replicationListBytes {
+		return nil
+	}
+	return fw.writeList()
+}
+
+func (fw *frameWriter) writeList() error {
+	if len(fw.list.Kv) == 0 {
+		return nil
+	}
+	b, err := fw.list.Marshal()
+	if err != nil {
+		return err
+	}
+	err = binary.Write(fw.w, binary.LittleEndian, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	_, err = fw.w.Write(b)
+	if err != nil {
+		return err
+	}
+	fw.list.Reset()
+	fw.size, fw.written = 0, true
+	return nil
+}
+
+// end ends the frame with the given version. Nothing is written if the frame
+// has no changes.
+func (fw *frameWriter) end(version uint64) error {
+	err := fw.writeList()
+	if err != nil || !fw.written {
+		return err
+	}
+	err = binary.Write(fw.w, binary.LittleEndian, uint64(0))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(fw.w, binary.LittleEndian, version)
+	if err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
+
+// Follow applies the changes streamed over rw by a leader calling
+// ServeReplication, until ctx is done or rw fails. The version of the leader
+// that's been applied is stored in the database, so that Follow resumes
+// where it stopped when called again, even after a restart.
+//
+// If rw is an io.Closer, it's closed when ctx is done.
+//
+// A follower must not be written to other than by Follow. To promote it to
+// a leader, stop following and reopen it.
+func (db *DB) Follow(ctx context.Context, rw io.ReadWriter) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if c, ok := rw.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { c.Close() })
+		defer stop()
+	}
+	applied, err := db.ReplicatedVersion()
+	if err != nil {
+		return err
+	}
+	err = binary.Write(rw, binary.LittleEndian, applied)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(rw, 16<<10)
+	for {
+		err = db.applyReplicationFrame(r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
+// FollowDB is like Follow, but replicates leader, another database in the
+// same process.
+func (db *DB) FollowDB(ctx context.Context, leader *DB) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l, f := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		defer l.Close()
+		errc <- leader.ServeReplication(ctx, l)
+	}()
+	err := db.Follow(ctx, f)
+	cancel()
+	if lerr := <-errc; ctx.Err() == nil && err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// ReplicatedVersion returns the version of the leader that the database has
+// applied as a follower, or 0 if it hasn't.
+func (db *DB) ReplicatedVersion() (uint64, error) {
+	var version uint64
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(replicationKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			if len(value) == 8 {
+				version = binary.BigEndian.Uint64(value)
+			}
+			return nil
+		})
+	})
+	return version, err
+}
+
+// applyReplicationFrame reads a frame written by a frameWriter and applies
+// it, along with its version.
+func (db *DB) applyReplicationFrame(r io.Reader) error {
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	var list pb.KVList
+	var b, lastKey []byte
+	for {
+		var size uint64
+		err := binary.Read(r, binary.LittleEndian, &size)
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+		if uint64(cap(b)) < size {
+			b = make([]byte, size)
+		}
+		b = b[:size]
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+		list.Reset()
+		err = list.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			// Versions of a key are listed from newest to oldest, and only
+			// the newest matters.
+			if bytes.Equal(kv.Key, lastKey) {
+				continue
+			}
+			lastKey = kv.Key
+			switch {
+			case len(kv.Meta) > 0 && kv.Meta[0]&badgerBitDelete != 0:
+				err = wb.Delete(kv.Key)
+			case len(kv.UserMeta) > 0:
+				// Such as tombstones of records in buckets with history.
+				err = wb.SetEntry(badger.NewEntry(kv.Key, kv.Value).WithMeta(kv.UserMeta[0]))
+			default:
+				err = wb.Set(kv.Key, kv.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	var version uint64
+	err := binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, version)
+	err = wb.Set(replicationKey, value)
+	if err != nil {
+		return err
+	}
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+	return db.reloadMeta()
+}
+
+// reloadMeta rereads the metadata of buckets and namespaces, after they were
+// replicated.
+func (db *DB) reloadMeta() error {
+	db.metaMu.Lock()
+	defer db.metaMu.Unlock()
+	db.meta = meta{}
+	db.namespaces = make(map[string]*namespaceMeta)
+	return db.readMeta(nil)
+}
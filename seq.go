@@ -0,0 +1,192 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"iter"
+	"runtime"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Record is a record yielded by Bucket.All and Bucket.PrefixSeq. It's only
+// valid until the loop continues to the next record.
+type Record struct {
+	bucket *Bucket
+	item   *badger.Item
+
+	// value is the value of the record if it was intercepted, since an
+	// Interceptor may replace it.
+	value       []byte
+	intercepted bool
+}
+
+// Key returns the key of the record.
+func (r *Record) Key() []byte {
+	return r.item.Key()[len(r.bucket.prefix):]
+}
+
+// Value returns a copy of the undecoded value of the record.
+func (r *Record) Value() ([]byte, error) {
+	if r.intercepted {
+		return append([]byte(nil), r.value...), nil
+	}
+	return r.item.ValueCopy(nil)
+}
+
+// Decode decodes the record into v, which must be a pointer to a struct.
+func (r *Record) Decode(v interface{}) error {
+	typ, err := newStructType(v, true)
+	if err != nil {
+		return err
+	}
+	return r.decode(typ, v)
+}
+
+func (r *Record) decode(typ *structType, v interface{}) error {
+	return r.valueFunc(func(value []byte) error {
+		return r.bucket.decode(typ, r.Key(), value, v)
+	})
+}
+
+// valueFunc calls fn with the undecoded value of the record.
+func (r *Record) valueFunc(fn func(value []byte) error) error {
+	if r.intercepted {
+		return fn(r.value)
+	}
+	return r.item.Value(fn)
+}
+
+// intercept passes the record through the interceptors of an iteration.
+func (r *Record) intercept(ctx context.Context, keysOnly bool) error {
+	call := &Call{Context: ctx, Kind: CallIterate, Bucket: r.bucket.name, Key: r.Key()}
+	err := r.bucket.db.intercept(call, func(call *Call) error {
+		if keysOnly {
+			return nil
+		}
+		var err error
+		call.Value, err = r.item.ValueCopy(nil)
+		return err
+	})
+	if !keysOnly {
+		r.value, r.intercepted = call.Value, true
+	}
+	return err
+}
+
+// All returns an iterator over all the records in the bucket, to be used
+// with a for-range loop. The underlying transaction is closed when the loop
+// ends. If an error occurs, it's yielded along with a nil Record, and the
+// iteration stops.
+func (b *Bucket) All() iter.Seq2[*Record, error] {
+	return b.PrefixSeq(nil)
+}
+
+// PrefixSeq is like All, but only iterates the records whose key has the
+// given prefix.
+func (b *Bucket) PrefixSeq(prefix interface{}) iter.Seq2[*Record, error] {
+	return func(yield func(*Record, error) bool) {
+		r, err := b.prefixRange(prefix)
+		if err == nil {
+			err = b.iterate(r, false, func(rec *Record) bool {
+				return yield(rec, nil)
+			})
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Keys returns an iterator over the keys of all the records in the bucket.
+// Values aren't read, which makes it much faster than All.
+//
+// Yielded keys are only valid until the loop continues to the next key.
+func (b *Bucket) Keys() iter.Seq2[[]byte, error] {
+	return b.PrefixKeys(nil)
+}
+
+// PrefixKeys is like Keys, but only iterates the keys with the given prefix.
+func (b *Bucket) PrefixKeys(prefix interface{}) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		r, err := b.prefixRange(prefix)
+		if err == nil {
+			err = b.iterate(r, true, func(rec *Record) bool {
+				return yield(rec.Key(), nil)
+			})
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// keyRange selects the keys of a bucket that have prefix, and are greater
+// than or equal to start and less than end, unless either is nil.
+type keyRange struct {
+	prefix, start, end []byte
+}
+
+// prefixRange returns the keyRange of the keys with the given prefix, which
+// may be nil, or a KeyError if it can't be encoded.
+func (b *Bucket) prefixRange(prefix interface{}) (keyRange, error) {
+	if prefix == nil {
+		return keyRange{}, nil
+	}
+	p, err := b.encodeKey("iterate", prefix)
+	return keyRange{prefix: p}, err
+}
+
+// iterate calls fn for each record whose key is in r until fn returns false.
+func (b *Bucket) iterate(r keyRange, keysOnly bool, fn func(rec *Record) bool) error {
+	if b.err != nil {
+		return b.err
+	}
+	ip := b.internalKey(r.prefix)
+	seek := ip
+	if r.start != nil {
+		if start := b.internalKey(r.start); bytes.Compare(start, seek) > 0 {
+			seek = start
+		}
+	}
+	var end []byte
+	if r.end != nil {
+		end = b.internalKey(r.end)
+	}
+	opts := badger.DefaultIteratorOptions
+	if keysOnly {
+		opts.PrefetchValues = false
+	} else {
+		opts.PrefetchSize = runtime.GOMAXPROCS(-1)
+	}
+	txn, discard := b.readTxn()
+	if discard {
+		defer txn.Discard()
+	}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	m := b.metrics()
+	for it.Seek(seek); it.ValidForPrefix(ip); it.Next() {
+		if end != nil && bytes.Compare(it.Item().Key(), end) >= 0 {
+			break
+		}
+		if it.Item().UserMeta()&tombstone != 0 {
+			continue
+		}
+		m.iterated.Add(1)
+		rec := &Record{bucket: b, item: it.Item()}
+		if len(b.db.interceptors) > 0 {
+			err := rec.intercept(context.Background(), keysOnly)
+			if err == ErrSkip {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !fn(rec) {
+			break
+		}
+	}
+	return nil
+}
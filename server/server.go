@@ -0,0 +1,319 @@
+// Package server exposes a Bow database over HTTP.
+//
+// Routes:
+//
+//	GET    /buckets                list the buckets
+//	GET    /buckets/{name}         list records, paginated
+//	GET    /buckets/{name}/{key}   get a record
+//	PUT    /buckets/{name}/{key}   put a record
+//	DELETE /buckets/{name}/{key}   delete a record
+//
+// Records are transferred in the encoding of the database's codec, and
+// indexed when put if the bucket's type is set with bow.SetBucketType. Keys in
+// paths are strings, unless the query parameter binary=true is given, in
+// which case they're in the form of bow.Id.String.
+//
+// Requests to buckets that don't exist are answered with 404 Not Found,
+// unless PUT is allowed to create them with SetCreateBuckets.
+//
+// Listing accepts the query parameters prefix, limit and after. The response
+// holds the records in the format of bow.Bucket.Export, and the value of after
+// for the next page, if there is one.
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zippoxer/bow"
+	"github.com/zippoxer/bow/codec"
+)
+
+// DefaultLimit is the amount of records listed when limit isn't given.
+const DefaultLimit = 100
+
+// MaxLimit is the maximum amount of records listed in a single request.
+const MaxLimit = 1000
+
+// DefaultMaxRecordSize is the maximum size in bytes of a record put, unless
+// set with SetMaxRecordSize.
+const DefaultMaxRecordSize = 1 << 20
+
+// Option is a function that configures a Server.
+type Option func(s *Server)
+
+// SetReadOnly rejects PUT and DELETE requests, as SetReadOnly does for bow.DB.
+func SetReadOnly(readOnly bool) Option {
+	return func(s *Server) {
+		s.readOnly = readOnly
+	}
+}
+
+// SetMaxRecordSize sets the maximum size in bytes of a record put. Larger
+// records are rejected with 413 Request Entity Too Large.
+func SetMaxRecordSize(size int64) Option {
+	return func(s *Server) {
+		s.maxRecordSize = size
+	}
+}
+
+// SetCreateBuckets lets PUT create the buckets that don't exist.
+func SetCreateBuckets(create bool) Option {
+	return func(s *Server) {
+		s.createBuckets = create
+	}
+}
+
+// Server is an http.Handler serving a Bow database.
+type Server struct {
+	db            *bow.DB
+	readOnly      bool
+	createBuckets bool
+	maxRecordSize int64
+}
+
+// New returns a Server for the given database.
+func New(db *bow.DB, options ...Option) *Server {
+	s := &Server{db: db, maxRecordSize: DefaultMaxRecordSize}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+type record struct {
+	Key    string          `json:"key"`
+	Binary bool            `json:"binary,omitempty"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type page struct {
+	Records []record `json:"records"`
+	After   string   `json:"after,omitempty"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "buckets" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	for i, part := range parts {
+		var err error
+		parts[i], err = url.PathUnescape(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(parts) > 1 && parts[1] == "" {
+		http.Error(w, "empty bucket name", http.StatusBadRequest)
+		return
+	}
+	switch len(parts) {
+	case 1:
+		if !s.allow(w, r, http.MethodGet) {
+			return
+		}
+		s.writeJSON(w, s.db.Buckets())
+	case 2:
+		if !s.allow(w, r, http.MethodGet) {
+			return
+		}
+		s.list(w, r, parts[1])
+	case 3:
+		methods := []string{http.MethodGet, http.MethodPut, http.MethodDelete}
+		if s.readOnly {
+			methods = methods[:1]
+		}
+		if !s.allow(w, r, methods...) {
+			return
+		}
+		key, err := bow.ParseKey(parts[2], r.URL.Query().Get("binary") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.get(w, r, parts[1], key)
+		case http.MethodPut:
+			s.put(w, r, parts[1], key)
+		case http.MethodDelete:
+			s.delete(w, r, parts[1], key)
+		}
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	limit := DefaultLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+	}
+	var after []byte
+	if v := query.Get("after"); v != "" {
+		var err error
+		after, err = base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	bucket, ok := s.db.LookupBucket(name)
+	if !ok {
+		http.Error(w, bow.ErrBucketNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	iter := bucket.PrefixContext(r.Context(), query.Get("prefix"))
+	defer iter.Close()
+	if after != nil {
+		// Seek to the smallest key greater than after.
+		iter.Seek(append(after, 0))
+	}
+	p := page{Records: []record{}}
+	var key, value []byte
+	for len(p.Records) < limit && iter.NextBytes(&key, &value) {
+		rec := record{}
+		rec.Key, rec.Binary = bow.FormatKey(key)
+		j, err := s.toJSON(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Copy since value is reused by the next iteration.
+		rec.Value = append(json.RawMessage(nil), j...)
+		p.Records = append(p.Records, rec)
+	}
+	if err := iter.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(p.Records) == limit && iter.NextBytes(nil, nil) {
+		p.After = base64.RawURLEncoding.EncodeToString(key)
+	}
+	s.writeJSON(w, p)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, name string, key []byte) {
+	bucket, ok := s.db.LookupBucket(name)
+	if !ok {
+		http.Error(w, bow.ErrBucketNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	data, err := bucket.GetBytesContext(r.Context(), key, nil)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", s.contentType())
+	w.Write(data)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, name string, key []byte) {
+	bucket, ok := s.db.LookupBucket(name)
+	if !ok && !s.createBuckets {
+		http.Error(w, bow.ErrBucketNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxRecordSize))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		bucket = s.db.Bucket(name)
+	}
+	err = bucket.PutBytesContext(r.Context(), key, data)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, name string, key []byte) {
+	bucket, ok := s.db.LookupBucket(name)
+	if !ok {
+		http.Error(w, bow.ErrBucketNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	err := bucket.DeleteContext(r.Context(), key)
+	if err != nil {
+		s.error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allow responds with 405 Method Not Allowed and returns false unless the
+// request's method is one of methods.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func (s *Server) error(w http.ResponseWriter, err error) {
+	var codecErr *bow.CodecError
+	switch {
+	case errors.Is(err, bow.ErrNotFound), errors.Is(err, bow.ErrBucketNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &codecErr) && codecErr.Op == "unmarshal":
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, bow.ErrReadOnly):
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// toJSON converts a value to JSON if the codec supports it, and otherwise
+// to a base64 JSON string.
+func (s *Server) toJSON(value []byte) (json.RawMessage, error) {
+	if tc, ok := s.db.Codec().(codec.JSONTranscoder); ok {
+		return tc.ToJSON(value)
+	}
+	return json.Marshal(value)
+}
+
+func (s *Server) contentType() string {
+	switch s.db.Codec().Format() {
+	case codec.JSON:
+		return "application/json"
+	case codec.MessagePack:
+		return "application/msgpack"
+	}
+	return "application/octet-stream"
+}
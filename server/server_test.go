@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/zippoxer/bow"
+)
+
+type Page struct {
+	URL   string `bow:"key"`
+	Title string
+}
+
+func TestServer(t *testing.T) {
+	db := openTestDB(t)
+	db.Bucket("pages")
+
+	srv := httptest.NewServer(New(db))
+	defer srv.Close()
+
+	for _, p := range []Page{{"a/1", "One"}, {"a/2", "Two"}, {"a/3", "Three"}, {"b/1", "Other"}} {
+		b, _ := json.Marshal(p)
+		res := do(t, http.MethodPut, srv.URL+"/buckets/pages/"+strings.Replace(p.URL, "/", "%2F", -1), string(b))
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("PUT: unexpected status %s", res.Status)
+		}
+	}
+
+	res := do(t, http.MethodGet, srv.URL+"/buckets/pages/a%2F2", "")
+	var got Page
+	decode(t, res, &got)
+	if got.Title != "Two" {
+		t.Fatalf("GET: unexpected record %v", got)
+	}
+
+	// List with a prefix, a page at a time.
+	var titles []string
+	after := ""
+	for {
+		res = do(t, http.MethodGet, srv.URL+"/buckets/pages?prefix=a/&limit=2&after="+after, "")
+		var p page
+		decode(t, res, &p)
+		for _, rec := range p.Records {
+			var page Page
+			if err := json.Unmarshal(rec.Value, &page); err != nil {
+				t.Fatal(err)
+			}
+			titles = append(titles, page.Title)
+		}
+		if p.After == "" {
+			break
+		}
+		after = p.After
+	}
+	if strings.Join(titles, ",") != "One,Two,Three" {
+		t.Fatalf("unexpected listing %v", titles)
+	}
+
+	res = do(t, http.MethodDelete, srv.URL+"/buckets/pages/a%2F2", "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodGet, srv.URL+"/buckets/pages/a%2F2", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET deleted: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodGet, srv.URL+"/buckets/missing", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET missing bucket: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodPut, srv.URL+"/buckets/missing/a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("PUT missing bucket: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodPut, srv.URL+"/buckets//a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT empty bucket name: unexpected status %s", res.Status)
+	}
+
+	var buckets []string
+	decode(t, do(t, http.MethodGet, srv.URL+"/buckets", ""), &buckets)
+	if len(buckets) != 1 || buckets[0] != "pages" {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	db := openTestDB(t)
+
+	srv := httptest.NewServer(New(db, SetReadOnly(true)))
+	defer srv.Close()
+
+	res := do(t, http.MethodPut, srv.URL+"/buckets/pages/a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("PUT: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodDelete, srv.URL+"/buckets/pages/a", "")
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE: unexpected status %s", res.Status)
+	}
+}
+
+func TestServerMaxRecordSize(t *testing.T) {
+	db := openTestDB(t)
+	db.Bucket("pages")
+	srv := httptest.NewServer(New(db, SetMaxRecordSize(16)))
+	defer srv.Close()
+
+	res := do(t, http.MethodPut, srv.URL+"/buckets/pages/a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodPut, srv.URL+"/buckets/pages/b", `{"Title":"Too long"}`)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT too large: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodGet, srv.URL+"/buckets/pages/b", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET too large: unexpected status %s", res.Status)
+	}
+}
+
+func TestServerCreateBuckets(t *testing.T) {
+	db := openTestDB(t)
+	srv := httptest.NewServer(New(db, SetCreateBuckets(true)))
+	defer srv.Close()
+
+	res := do(t, http.MethodPut, srv.URL+"/buckets/pages/a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT: unexpected status %s", res.Status)
+	}
+	res = do(t, http.MethodPut, srv.URL+"/buckets//a", `{"Title":"A"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT empty bucket name: unexpected status %s", res.Status)
+	}
+	var buckets []string
+	decode(t, do(t, http.MethodGet, srv.URL+"/buckets", ""), &buckets)
+	if len(buckets) != 1 || buckets[0] != "pages" {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+}
+
+type Member struct {
+	Id   string `bow:"key"`
+	City string `bow:"index"`
+}
+
+func TestServerIndexes(t *testing.T) {
+	db := openTestDB(t, bow.SetBucketType("members", Member{}))
+	db.Bucket("members")
+	srv := httptest.NewServer(New(db))
+	defer srv.Close()
+
+	res := do(t, http.MethodPut, srv.URL+"/buckets/members/ada", `{"City":"London"}`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT: unexpected status %s", res.Status)
+	}
+	var found []Member
+	if err := db.Bucket("members").Query().Where("City", bow.Eq, "London").Find(&found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Id != "ada" {
+		t.Fatalf("expected ada to be indexed, got %v", found)
+	}
+	res = do(t, http.MethodPut, srv.URL+"/buckets/members/bad", `{"City":`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT malformed: unexpected status %s", res.Status)
+	}
+}
+
+func openTestDB(t *testing.T, options ...bow.Option) *bow.DB {
+	dir, err := ioutil.TempDir("", "bow-server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	db, err := bow.Open(dir, append([]bow.Option{bow.SetBadgerOptions(opts)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+func do(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func decode(t *testing.T, res *http.Response, v interface{}) {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: unexpected status %s", res.Request.Method, res.Request.URL, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
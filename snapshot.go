@@ -0,0 +1,46 @@
+package bow
+
+import (
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Snapshot is a read-only view of the database at a single point in time.
+// Buckets obtained from it see the same state, regardless of writes made
+// after the Snapshot was taken, until Close is called.
+//
+// Put and Delete on buckets of a Snapshot return ErrReadOnly.
+type Snapshot struct {
+	db  *DB
+	txn *badger.Txn
+}
+
+// Snapshot returns a read-only view of the database as it is now.
+// Make sure to call Close after you're done, since Badger can't discard the
+// versions of records that a Snapshot may read.
+func (db *DB) Snapshot() *Snapshot {
+	return &Snapshot{db: db, txn: db.db.NewTransaction(false)}
+}
+
+// Bucket returns the named bucket as it was when the Snapshot was taken.
+// If the bucket doesn't exist, then any operation on it returns a BucketError
+// wrapping ErrBucketNotFound.
+func (s *Snapshot) Bucket(name string) *Bucket {
+	bucket, ok := s.db.bucket(name)
+	if !ok {
+		return &Bucket{db: s.db, name: name, err: &BucketError{Bucket: name, Op: "open", Err: ErrBucketNotFound}}
+	}
+	bucket.txn = s.txn
+	return bucket
+}
+
+// Version returns the version of the database the Snapshot sees, which
+// includes every change committed at or before it.
+func (s *Snapshot) Version() uint64 {
+	return s.txn.ReadTs()
+}
+
+// Close releases the Snapshot. Buckets obtained from it must not be used
+// afterwards.
+func (s *Snapshot) Close() {
+	s.txn.Discard()
+}
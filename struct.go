@@ -3,25 +3,62 @@ package bow
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	// structCache is a cache of types to their key field index.
-	structCache   = make(map[reflect.Type]int)
+	// structCache is a cache of types to their parsed fields.
+	structCache   = make(map[reflect.Type]*structFields)
 	structCacheMu sync.RWMutex
 
-	typeOfId = reflect.TypeOf(Id(""))
+	typeOfId    = reflect.TypeOf(Id(""))
+	typeOfBytes = reflect.TypeOf([]byte(nil))
+	typeOfTime  = reflect.TypeOf(time.Time{})
 )
 
 type structType struct {
-	typ  reflect.Type
-	ki   int
-	ptrs int
+	typ    reflect.Type
+	fields *structFields
+	ptrs   int
+}
+
+// structFields describes the fields of a struct type that Bow treats specially.
+type structFields struct {
+	// key is the index of the key field, or -1 if there isn't one.
+	key int
+
+	// encrypt holds the indexes of fields tagged with `bow:"encrypt"`.
+	encrypt []int
+
+	// text holds the indexes of fields tagged with `bow:"text"`.
+	text []int
+
+	// index holds the indexes of fields tagged with `bow:"index"`.
+	index []int
+
+	// refs holds the fields tagged with `bow:"ref=bucket"`.
+	refs []refField
+
+	// geo is the index of the field tagged with `bow:"geo"`, or -1 if there
+	// isn't one.
+	geo int
+
+	// created and updated are the indexes of the fields tagged with
+	// `bow:"created"` and `bow:"updated"`, or -1 if there aren't any.
+	created, updated int
+
+	// Whether pointers to the type implement BeforePutter, AfterGetter and
+	// BeforeDeleter.
+	beforePut, afterGet, beforeDelete bool
 }
 
 func newStructType(v interface{}, mustAddr bool) (*structType, error) {
 	typ := reflect.TypeOf(v)
+	if typ == nil {
+		return nil, fmt.Errorf("type <nil> is not a struct")
+	}
 	var kind reflect.Kind
 	var ptrs int
 	for {
@@ -39,41 +76,175 @@ func newStructType(v interface{}, mustAddr bool) (*structType, error) {
 		return nil, fmt.Errorf(
 			"type %s is not addressable, did you forget to pass a pointer?", typ)
 	}
-	return &structType{typ: typ, ptrs: ptrs, ki: -2}, nil
+	return &structType{typ: typ, ptrs: ptrs}, nil
 }
 
-func (t *structType) keyIndex() (int, error) {
-	if t.ki != -2 {
-		return t.ki, nil
+// structFields returns the parsed fields of the type, parsing them on the first
+// call for each type.
+func (t *structType) structFields() (*structFields, error) {
+	if t.fields != nil {
+		return t.fields, nil
 	}
 	structCacheMu.RLock()
-	fieldIndex, ok := structCache[t.typ]
+	fields, ok := structCache[t.typ]
 	structCacheMu.RUnlock()
 	if ok {
-		return fieldIndex, nil
+		t.fields = fields
+		return fields, nil
 	}
-	fieldIndex = -1
-	for i := 0; i < t.typ.NumField(); i++ {
-		field := t.typ.Field(i)
-		if field.Type == typeOfId {
-			fieldIndex = i
-			break
+	fields, err := parseStructFields(t.typ)
+	if err != nil {
+		return nil, err
+	}
+	t.fields = fields
+	structCacheMu.Lock()
+	structCache[t.typ] = fields
+	structCacheMu.Unlock()
+	return fields, nil
+}
+
+// indexed reports whether records have fields that are indexed, or hold
+// references that are checked or indexed.
+func (f *structFields) indexed() bool {
+	return len(f.text) > 0 || f.geo != -1 || len(f.index) > 0 || len(f.refs) > 0
+}
+
+// pointer returns the type of a single pointer to the struct.
+func (t *structType) pointer() *structType {
+	return &structType{typ: t.typ, fields: t.fields, ptrs: 1}
+}
+
+func (t *structType) keyIndex() (int, error) {
+	fields, err := t.structFields()
+	if err != nil {
+		return 0, err
+	}
+	return fields.key, nil
+}
+
+func parseStructFields(typ reflect.Type) (*structFields, error) {
+	ptr := reflect.PtrTo(typ)
+	fields := &structFields{
+		key:          -1,
+		geo:          -1,
+		created:      -1,
+		updated:      -1,
+		beforePut:    ptr.Implements(typeOfBeforePutter),
+		afterGet:     ptr.Implements(typeOfAfterGetter),
+		beforeDelete: ptr.Implements(typeOfBeforeDeleter),
+	}
+	// The first field of type Id is the key. Without one, the last field
+	// tagged with `bow:"key"` is.
+	keyFound := false
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Type == typeOfId && !keyFound {
+			fields.key = i
+			keyFound = true
 		}
-		flag, ok := field.Tag.Lookup("bow")
+		tag, ok := field.Tag.Lookup("bow")
 		if !ok {
 			continue
 		}
-		switch flag {
-		case "key":
-			fieldIndex = i
-			break
+		flags := strings.Split(tag, ",")
+		onDelete := refNoAction
+		for _, flag := range flags {
+			if bucket, ok := strings.CutPrefix(flag, "ref="); ok {
+				if !isRefType(field.Type) || bucket == "" {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged ref but isn't a key or a slice of keys",
+						typ, field.Name)
+				}
+				fields.refs = append(fields.refs, refField{index: i, bucket: bucket})
+				continue
+			}
+			switch flag {
+			case "cascade":
+				onDelete = refCascade
+			case "restrict":
+				onDelete = refRestrict
+			case "nullify":
+				onDelete = refNullify
+			case "key":
+				if !keyFound {
+					fields.key = i
+				}
+			case "encrypt":
+				if field.Type.Kind() != reflect.String &&
+					!field.Type.ConvertibleTo(typeOfBytes) {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged encrypt but isn't a string or []byte",
+						typ, field.Name)
+				}
+				fields.encrypt = append(fields.encrypt, i)
+			case "text":
+				if field.Type.Kind() != reflect.String {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged text but isn't a string",
+						typ, field.Name)
+				}
+				for _, f := range flags {
+					if f == "encrypt" {
+						return nil, fmt.Errorf(
+							"field %s.%s can't be tagged both text and encrypt",
+							typ, field.Name)
+					}
+				}
+				fields.text = append(fields.text, i)
+			case "index":
+				if !isIndexType(field.Type) {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged index but isn't a string, []byte, bool, number or time.Time",
+						typ, field.Name)
+				}
+				if !field.IsExported() {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged index but isn't exported",
+						typ, field.Name)
+				}
+				for _, f := range flags {
+					if f == "encrypt" {
+						return nil, fmt.Errorf(
+							"field %s.%s can't be tagged both index and encrypt",
+							typ, field.Name)
+					}
+				}
+				fields.index = append(fields.index, i)
+			case "geo":
+				if !isGeoType(field.Type) {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged geo but isn't a struct with float64 Lat and Lng",
+						typ, field.Name)
+				}
+				if fields.geo != -1 {
+					return nil, fmt.Errorf(
+						"type %s has more than one field tagged geo", typ)
+				}
+				fields.geo = i
+			case "created", "updated":
+				if field.Type != typeOfTime {
+					return nil, fmt.Errorf(
+						"field %s.%s is tagged %s but isn't a time.Time",
+						typ, field.Name, flag)
+				}
+				if flag == "created" {
+					fields.created = i
+				} else {
+					fields.updated = i
+				}
+			}
+		}
+		if onDelete != refNoAction {
+			n := len(fields.refs)
+			if n == 0 || fields.refs[n-1].index != i {
+				return nil, fmt.Errorf(
+					"field %s.%s is tagged cascade, restrict or nullify but not ref",
+					typ, field.Name)
+			}
+			fields.refs[n-1].onDelete = onDelete
 		}
 	}
-	t.ki = fieldIndex
-	structCacheMu.Lock()
-	structCache[t.typ] = fieldIndex
-	structCacheMu.Unlock()
-	return fieldIndex, nil
+	return fields, nil
 }
 
 func (t *structType) value(v interface{}) *structValue {
@@ -92,6 +263,18 @@ type structValue struct {
 	value reflect.Value
 }
 
+// addr returns a pointer to the struct. If the struct isn't addressable,
+// the pointer is to a copy of it.
+func (v *structValue) addr() interface{} {
+	if v.value.CanAddr() {
+		return v.value.Addr().Interface()
+	}
+	p := reflect.New(v.value.Type())
+	p.Elem().Set(v.value)
+	v.value = p.Elem()
+	return p.Interface()
+}
+
 func (v *structValue) key() ([]byte, error) {
 	fieldIndex, err := v.typ.keyIndex()
 	if err != nil {
@@ -0,0 +1,289 @@
+package bow
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Prefix reserved for full-text indexes of fields tagged with `bow:"text"`.
+//
+// A bucket's index is prefixed with textPrefix followed by the bucket's
+// prefix, and holds:
+//
+//	't' term 0x00 key -> uvarint term frequency, uvarint document length
+//	'd' key           -> textDoc
+var textPrefix = []byte{reserved, 0x06}
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// stopwords are common English words that aren't indexed.
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true,
+	"if": true, "in": true, "into": true, "is": true, "it": true,
+	"no": true, "not": true, "of": true, "on": true, "or": true,
+	"such": true, "that": true, "the": true, "their": true, "then": true,
+	"there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+// textDoc is the indexed form of a record, kept to remove its terms from the
+// index when it's updated or deleted.
+type textDoc struct {
+	Len   int
+	Terms []string
+}
+
+// textStats are the statistics of a bucket's index that BM25 needs.
+type textStats struct {
+	docs     int
+	totalLen int
+}
+
+// Match is a record found by Search.
+type Match struct {
+	// Key is the key of the record. Retrieve the record with Get(Key, &v).
+	Key []byte
+
+	// Score is the relevance of the record to the query.
+	Score float64
+}
+
+// Search finds the records whose fields tagged with `bow:"text"` match the
+// query, ranked by relevance using BM25. A record matches if it contains any
+// of the words in the query, and ranks higher the more it contains. If limit
+// is positive, at most limit matches are returned.
+//
+// Records are indexed by Put and Delete, and by PutBytes and Import if the
+// bucket's type is set with SetBucketType or passed to Import. Restore
+// restores the index along with the records.
+func (b *Bucket) Search(query string, limit int) ([]Match, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	err := b.view(context.Background(), func(txn *badger.Txn) error {
+		// Stats are computed within the transaction of the postings, so
+		// that they agree with them.
+		stats, err := b.textStats(txn)
+		if err != nil || stats.docs == 0 {
+			return err
+		}
+		avgLen := float64(stats.totalLen) / float64(stats.docs)
+		for _, term := range terms {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+			prefix := b.textTermKey(term, nil)
+			type posting struct {
+				key     string
+				tf, len float64
+			}
+			var postings []posting
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				p := posting{key: string(item.Key()[len(prefix):])}
+				err := item.Value(func(value []byte) error {
+					tf, n := binary.Uvarint(value)
+					dl, _ := binary.Uvarint(value[n:])
+					p.tf, p.len = float64(tf), float64(dl)
+					return nil
+				})
+				if err != nil {
+					it.Close()
+					return err
+				}
+				postings = append(postings, p)
+			}
+			it.Close()
+
+			df := float64(len(postings))
+			idf := math.Log(1 + (float64(stats.docs)-df+0.5)/(df+0.5))
+			for _, p := range postings {
+				norm := 1 - bm25B + bm25B*p.len/avgLen
+				scores[p.key] += idf * p.tf * (bm25K1 + 1) / (p.tf + bm25K1*norm)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]Match, 0, len(scores))
+	for key, score := range scores {
+		matches = append(matches, Match{Key: []byte(key), Score: score})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return bytes.Compare(matches[i].Key, matches[j].Key) < 0
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// textStats computes the statistics of the bucket's index within txn.
+func (b *Bucket) textStats(txn *badger.Txn) (textStats, error) {
+	var s textStats
+	prefix := b.textDocKey(nil)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var doc textDoc
+		err := it.Item().Value(func(value []byte) error {
+			return json.Unmarshal(value, &doc)
+		})
+		if err != nil {
+			return s, err
+		}
+		s.docs++
+		s.totalLen += doc.Len
+	}
+	return s, nil
+}
+
+// indexText updates the index of the record with the given key, to the
+// fields of sv tagged with `bow:"text"`, within tx.
+func (b *Bucket) indexText(tx *Tx, fields *structFields, sv *structValue, key []byte) error {
+	err := b.unindexText(tx, key)
+	if err != nil {
+		return err
+	}
+	freqs := make(map[string]int)
+	var doc textDoc
+	for _, i := range fields.text {
+		for _, term := range tokenize(sv.value.Field(i).String()) {
+			if freqs[term] == 0 {
+				doc.Terms = append(doc.Terms, term)
+			}
+			freqs[term]++
+			doc.Len++
+		}
+	}
+	for term, freq := range freqs {
+		value := binary.AppendUvarint(nil, uint64(freq))
+		value = binary.AppendUvarint(value, uint64(doc.Len))
+		err = tx.txn.Set(b.textTermKey(term, key), value)
+		if err != nil {
+			return err
+		}
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.txn.Set(b.textDocKey(key), value)
+}
+
+// unindexText removes the record with the given key from the index within
+// tx.
+func (b *Bucket) unindexText(tx *Tx, key []byte) error {
+	entries, err := b.textEntries(tx.txn, key)
+	if err != nil {
+		return err
+	}
+	return deleteKeys(tx.txn, entries)
+}
+
+// textEntries returns the keys of the index entries of the record with the
+// given key within txn, including its doc.
+func (b *Bucket) textEntries(txn *badger.Txn, key []byte) ([][]byte, error) {
+	docKey := b.textDocKey(key)
+	item, err := txn.Get(docKey)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc textDoc
+	err = item.Value(func(value []byte) error {
+		return json.Unmarshal(value, &doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]byte{docKey}
+	for _, term := range doc.Terms {
+		entries = append(entries, b.textTermKey(term, key))
+	}
+	return entries, nil
+}
+
+func (b *Bucket) textTermKey(term string, key []byte) []byte {
+	k := make([]byte, 0, len(textPrefix)+len(b.prefix)+len(term)+len(key)+2)
+	k = append(k, textPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 't')
+	k = append(k, term...)
+	k = append(k, 0)
+	return append(k, key...)
+}
+
+func (b *Bucket) textDocKey(key []byte) []byte {
+	k := make([]byte, 0, len(textPrefix)+len(b.prefix)+len(key)+1)
+	k = append(k, textPrefix...)
+	k = append(k, b.prefix...)
+	k = append(k, 'd')
+	return append(k, key...)
+}
+
+// tokenize splits s into lowercase words, leaving out stopwords, and stems
+// them.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := words[:0]
+	for _, w := range words {
+		if stopwords[w] {
+			continue
+		}
+		terms = append(terms, stem(w))
+	}
+	return terms
+}
+
+// stem strips common English suffixes from a lowercase word, so that
+// different forms of a word, such as "arrow" and "arrows", are indexed as
+// the same term.
+func stem(w string) string {
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ing") && len(w) > 5:
+		return w[:len(w)-3]
+	case strings.HasSuffix(w, "ed") && len(w) > 4:
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "ly") && len(w) > 4:
+		return w[:len(w)-2]
+	case strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") && len(w) > 3:
+		return w[:len(w)-1]
+	}
+	return w
+}
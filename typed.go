@@ -0,0 +1,129 @@
+package bow
+
+import (
+	"context"
+	"fmt"
+	"iter"
+)
+
+// TypedBucket is a bucket of records of type T, which must be a struct.
+//
+// Unlike Bucket, the type of records is checked once when the TypedBucket
+// is obtained with Typed, rather than on every operation.
+type TypedBucket[T any] struct {
+	bucket *Bucket
+	typ    *structType
+	err    error
+}
+
+// Typed returns the named bucket for records of type T, creating it if it
+// doesn't exist. If T isn't a valid record type, or an error has occurred
+// during creation, it would be returned by any operation on the returned
+// bucket.
+func Typed[T any](db *DB, name string) *TypedBucket[T] {
+	b := &TypedBucket[T]{bucket: db.Bucket(name)}
+	if b.bucket.err != nil {
+		b.err = b.bucket.err
+		return b
+	}
+	b.typ, b.err = typedStructType[T]()
+	return b
+}
+
+// typedStructType returns the structType of T, validating its fields and
+// the type of its key.
+func typedStructType[T any]() (*structType, error) {
+	var zero T
+	typ, err := newStructType(&zero, true)
+	if err != nil {
+		return nil, err
+	}
+	if typ.ptrs != 1 {
+		return nil, fmt.Errorf("type %T is not a struct", zero)
+	}
+	_, err = typ.structFields()
+	if err != nil {
+		return nil, err
+	}
+	_, err = typ.value(&zero).key()
+	if err != nil {
+		return nil, err
+	}
+	return typ, nil
+}
+
+// Bucket returns the untyped bucket.
+func (b *TypedBucket[T]) Bucket() *Bucket {
+	return b.bucket
+}
+
+// Get retrieves a record by key, returning an error wrapping ErrNotFound if
+// it doesn't exist.
+func (b *TypedBucket[T]) Get(key interface{}) (T, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done.
+func (b *TypedBucket[T]) GetContext(ctx context.Context, key interface{}) (T, error) {
+	var v T
+	if b.err != nil {
+		return v, b.err
+	}
+	err := b.bucket.get(ctx, b.typ, key, &v)
+	return v, err
+}
+
+// Put persists a record. If a record with the same key already exists, then
+// it will be updated.
+func (b *TypedBucket[T]) Put(v T) error {
+	return b.PutContext(context.Background(), v)
+}
+
+// PutContext is like Put, but aborts before committing if ctx is done.
+func (b *TypedBucket[T]) PutContext(ctx context.Context, v T) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.bucket.readOnly() {
+		return ErrReadOnly
+	}
+	return b.bucket.put(ctx, b.typ, &v)
+}
+
+// Delete removes a record by key.
+func (b *TypedBucket[T]) Delete(key interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.bucket.readOnly() {
+		return ErrReadOnly
+	}
+	keyBytes, err := b.bucket.encodeKey("delete", key)
+	if err != nil {
+		return err
+	}
+	return b.bucket.delete(context.Background(), b.typ, keyBytes)
+}
+
+// All returns an iterator over all the records in the bucket. Errors are
+// yielded along with a zero T, after which iteration stops.
+func (b *TypedBucket[T]) All() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if b.err != nil {
+			yield(zero, b.err)
+			return
+		}
+		err := b.bucket.iterate(keyRange{}, false, func(rec *Record) bool {
+			var v T
+			if err := rec.decode(b.typ, &v); err != nil {
+				yield(zero, err)
+				return false
+			}
+			return yield(v, nil)
+		})
+		if err != nil {
+			yield(zero, err)
+		}
+	}
+}